@@ -0,0 +1,493 @@
+/*
+* File: cmd/admin_commands.go
+*
+* Description: This file contains the commands used to manage users, links and sessions from the command line,
+*              e.g. ./server user add admin@example.com. They use the same database functions as the web server
+*
+ */
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+	"github.com/vtallen/go-link-shortener/internal/sessmngt"
+	"golang.org/x/term"
+)
+
+/*
+* Function: runUserCommand
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given after "user"
+*
+* Returns: error - Any error that occurred while running the command
+*
+* Description: Runs one of the user management commands: add, passwd, promote, demote, remove or list
+ */
+func runUserCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: user <add|passwd|promote|demote|remove|list>")
+	}
+
+	switch args[0] {
+	case "add":
+		return runUserAdd(db, args[1:])
+	case "passwd":
+		return runUserPasswd(db, args[1:])
+	case "promote":
+		return runUserSetPermissions(db, args[1:], "admin")
+	case "demote":
+		return runUserSetPermissions(db, args[1:], "user")
+	case "remove":
+		return runUserRemove(db, args[1:])
+	case "list":
+		return runUserList(db)
+	default:
+		return fmt.Errorf("unknown user command %q", args[0])
+	}
+}
+
+/*
+* Function: runUserAdd
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given after "user add"
+*
+* Returns: error - Any error that occurred while creating the user
+*
+* Description: Creates a user with a password read from standard input. The -admin flag gives the user admin
+*              permissions
+ */
+func runUserAdd(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("user add", flag.ContinueOnError)
+	admin := flags.Bool("admin", false, "Give the new user admin permissions")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: user add [-admin] <email>")
+	}
+	email := flags.Arg(0)
+
+	// The same checks are made as when registering through the website
+	if _, err := mail.ParseAddress(email); err != nil {
+		return errors.New("invalid email")
+	}
+	splitEmail := strings.Split(email, "@")
+	if len(splitEmail) != 2 {
+		return errors.New("invalid email")
+	}
+
+	if _, err := sessmngt.GetUserByEmail(db, email); err == nil {
+		return errors.New("user already exists")
+	}
+
+	hashedPassword, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+
+	permissions := "user"
+	if *admin {
+		permissions = "admin"
+	}
+
+	err = sessmngt.AddUser(db, email, splitEmail[0], hashedPassword, permissions)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Added %s %s\n", permissions, email)
+	return nil
+}
+
+/*
+* Function: runUserPasswd
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given after "user passwd"
+*
+* Returns: error - Any error that occurred while changing the password
+*
+* Description: Resets a user's password to one read from standard input and logs them out everywhere
+ */
+func runUserPasswd(db *sql.DB, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: user passwd <email>")
+	}
+
+	user, err := sessmngt.GetUserByEmail(db, args[0])
+	if err != nil {
+		return errors.New("user does not exist")
+	}
+
+	hashedPassword, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+
+	err = sessmngt.UpdateUserPassword(db, user.Email, hashedPassword)
+	if err != nil {
+		return err
+	}
+
+	// Existing sessions were created with the old password, so they are ended
+	_, err = sessmngt.DeleteUserSessions(db, user.Id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Changed the password of %s\n", user.Email)
+	return nil
+}
+
+/*
+* Function: runUserSetPermissions
+*
+* Parameters: db          *sql.DB  - A pointer to the database object
+*             args        []string - The arguments given after "user promote" or "user demote"
+*             permissions string   - The access level to give the user
+*
+* Returns: error - Any error that occurred while changing the permissions
+*
+* Description: Changes the access level of a user
+ */
+func runUserSetPermissions(db *sql.DB, args []string, permissions string) error {
+	if len(args) != 1 {
+		return errors.New("usage: user promote|demote <email>")
+	}
+
+	err := sessmngt.SetUserPermissions(db, args[0], permissions)
+	if err == sql.ErrNoRows {
+		return errors.New("user does not exist")
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s now has %s permissions\n", args[0], permissions)
+	return nil
+}
+
+/*
+* Function: runUserRemove
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given after "user remove"
+*
+* Returns: error - Any error that occurred while removing the user
+*
+* Description: Removes a user and their sessions. Their links are kept unless -links is given
+ */
+func runUserRemove(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("user remove", flag.ContinueOnError)
+	deleteLinks := flags.Bool("links", false, "Also delete every link the user created")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: user remove [-links] <email>")
+	}
+
+	user, err := sessmngt.GetUserByEmail(db, flags.Arg(0))
+	if err != nil {
+		return errors.New("user does not exist")
+	}
+
+	if *deleteLinks {
+		links, err := GetUserLinks(db, user.Id)
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			if err := DeleteLink(db, link.ID); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Deleted %d links\n", len(links))
+	}
+
+	_, err = sessmngt.DeleteUserSessions(db, user.Id)
+	if err != nil {
+		return err
+	}
+
+	err = sessmngt.RemoveUser(db, user.Email)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %s\n", user.Email)
+	return nil
+}
+
+/*
+* Function: runUserList
+*
+* Parameters: db *sql.DB - A pointer to the database object
+*
+* Returns: error - Any error that occurred while writing the list
+*
+* Description: Prints every user along with their permissions
+ */
+func runUserList(db *sql.DB) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tEMAIL\tUSERNAME\tPERMISSIONS")
+	for _, user := range GetAllUsers(db) {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\n", user.Id, user.Email, user.Username, user.Permissions)
+	}
+
+	return writer.Flush()
+}
+
+/*
+* Function: runLinksCommand
+*
+* Parameters: db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*             args   []string     - The arguments given after "links"
+*
+* Returns: error - Any error that occurred while running the command
+*
+* Description: Runs one of the link management commands: list, delete or prune
+ */
+func runLinksCommand(db *sql.DB, config *conf.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: links <list|delete|prune>")
+	}
+
+	switch args[0] {
+	case "list":
+		return runLinksList(db, config, args[1:])
+	case "delete":
+		return runLinksDelete(db, args[1:])
+	case "prune":
+		return runLinksPrune(db, args[1:])
+	default:
+		return fmt.Errorf("unknown links command %q", args[0])
+	}
+}
+
+/*
+* Function: runLinksList
+*
+* Parameters: db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*             args   []string     - The arguments given after "links list"
+*
+* Returns: error - Any error that occurred while reading or writing the links
+*
+* Description: Prints every link, or only the links of one user when -user is given
+ */
+func runLinksList(db *sql.DB, config *conf.Config, args []string) error {
+	flags := flag.NewFlagSet("links list", flag.ContinueOnError)
+	email := flags.String("user", "", "Only list the links of the user with this email")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var links []globalstructs.Link
+	if *email != "" {
+		user, err := sessmngt.GetUserByEmail(db, *email)
+		if err != nil {
+			return errors.New("user does not exist")
+		}
+		links, err = GetUserLinks(db, user.Id)
+		if err != nil {
+			return err
+		}
+	} else {
+		links = GetAllLinks(db)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSHORT URL\tUSER ID\tCLICKS\tURL")
+	for _, link := range links {
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%d\t%s\n", link.ID, ShortURL(config, link.Domain, link.Shortcode), link.UserId, link.Clicks, link.Url)
+	}
+
+	return writer.Flush()
+}
+
+/*
+* Function: runLinksDelete
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given after "links delete"
+*
+* Returns: error - Any error that occurred while deleting the links
+*
+* Description: Deletes links by shortcode, or by id when the argument is a number that is not also a shortcode.
+*              Links on one of server.domains are given as domain/shortcode
+ */
+func runLinksDelete(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: links delete <shortcode|id>...")
+	}
+
+	for _, arg := range args {
+		domain, shortcode, found := strings.Cut(arg, "/")
+		if !found {
+			domain, shortcode = "", arg
+		}
+
+		link, err := GetLinkByShortcode(db, domain, shortcode)
+		if err != nil {
+			id, convErr := strconv.Atoi(arg)
+			if convErr != nil {
+				return fmt.Errorf("no link with shortcode %s", arg)
+			}
+			link, err = GetLink(db, id)
+			if err != nil {
+				return fmt.Errorf("no link with shortcode or id %s", arg)
+			}
+		}
+
+		err = DeleteLink(db, link.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s -> %s\n", link.Shortcode, link.Url)
+	}
+
+	return nil
+}
+
+/*
+* Function: runLinksPrune
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given after "links prune"
+*
+* Returns: error - Any error that occurred while finding or deleting the links
+*
+* Description: Deletes every link that has not been created or clicked in the number of days given by -days. With
+*              -dry-run the links are only listed
+ */
+func runLinksPrune(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("links prune", flag.ContinueOnError)
+	days := flags.Int("days", 0, "Delete links that have not been created or clicked in this many days")
+	dryRun := flags.Bool("dry-run", false, "List the links that would be deleted without deleting them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *days <= 0 || flags.NArg() != 0 {
+		return errors.New("usage: links prune -days <n> [-dry-run]")
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -*days).Unix()
+
+	if *dryRun {
+		links, err := GetUnusedLinks(db, cutoff)
+		if err != nil {
+			return err
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tSHORTCODE\tCREATED\tLAST CLICKED\tURL")
+		for _, link := range links {
+			fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\n", link.ID, link.Shortcode, formatDate(link.CreatedAt), formatDate(link.LastClickedAt), link.Url)
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+
+		fmt.Printf("%d links would be deleted\n", len(links))
+		return nil
+	}
+
+	deleted, err := DeleteUnusedLinks(db, cutoff)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted %d links\n", deleted)
+	return nil
+}
+
+/*
+* Function: runSessionsCommand
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given after "sessions"
+*
+* Returns: error - Any error that occurred while running the command
+*
+* Description: Runs "sessions purge", which deletes every session or only the expired ones with -expired
+ */
+func runSessionsCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 || args[0] != "purge" {
+		return errors.New("usage: sessions purge [-expired]")
+	}
+
+	flags := flag.NewFlagSet("sessions purge", flag.ContinueOnError)
+	expired := flags.Bool("expired", false, "Only delete sessions that have expired")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var deleted int64
+	var err error
+	if *expired {
+		deleted, err = sessmngt.DeleteExpiredSessions(db)
+	} else {
+		deleted, err = sessmngt.DeleteAllSessions(db)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted %d sessions\n", deleted)
+	return nil
+}
+
+/*
+* Function: readNewPassword
+*
+* Parameters: None
+*
+* Returns: string - The password hashed with sessmngt.HashPassword
+*          error  - If no password was given or it does not meet the minimum requirements
+*
+* Description: Reads a password from the first line of standard input, so it can be typed in or piped from a
+*              secret store without appearing in the shell history. When standard input is a terminal the password
+*              is not echoed as it is typed
+ */
+func readNewPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+
+	var password string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		typed, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr) // The newline typed after the password is not echoed either
+		if err != nil {
+			return "", err
+		}
+		password = string(typed)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if !sessmngt.IsPasswordValid(password) {
+		return "", errors.New("password must be at least 7 characters and contain an uppercase letter, a lowercase letter, a number and a special character")
+	}
+
+	return sessmngt.HashPassword(password)
+}
@@ -0,0 +1,358 @@
+/*
+* File: cmd/bulk.go
+*
+* Description: This file contains the handler and helpers used to create many links at once from an uploaded
+*              CSV file. Every row is validated on its own, and all valid rows are stored in a single transaction
+*
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+	"github.com/vtallen/go-link-shortener/pkg/codegen"
+)
+
+// The maximum number of rows accepted in a single upload
+const maxBulkRows = 5000
+
+// Custom aliases may only contain characters that do not need escaping in a url path
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Path segments used by the server's own routes, these can never be used as an alias
+var reservedShortcodes = []string{"about", "api", "claim", "create", "css", "delete", "error", "images", "login", "logout", "register", "user"}
+
+/*
+* Struct: bulkRow
+*
+* Description: Holds one row of an uploaded CSV along with the result of creating its link
+ */
+type bulkRow struct {
+	URL       string // The url to shorten
+	Alias     string // The optional custom shortcode for the link
+	Tags      string // The optional tags for the link
+	Expiry    string // The optional expiry date or time of the link
+	Shortcode string // The shortcode of the created link, empty if the row failed
+	Error     string // The reason the row failed, empty if the link was created
+}
+
+/*
+* Function: HandleBulkCreate
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error writing the response
+*
+* Description: Handles a POST request containing a CSV file of links to create, either as the "file" field of a
+*              multipart form or as the raw request body. Each row holds a url and optionally an alias, tags and an
+*              expiry. A CSV describing the result of every row is sent back as a download
+*
+ */
+func HandleBulkCreate(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	sess, err := session.Get("session", c)
+	if err != nil {
+		c.Logger().Errorf("Could not get session from context: %s\n", err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	userId, ok := sess.Values["userId"].(int)
+	if !ok {
+		c.Logger().Errorf("Could not convert the session userId to int.\n")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	// Every link of an upload is created on the same domain, given as a form field or in the query string
+	domain, err := formDomain(config, c.FormValue("domain"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Unknown domain")
+	}
+
+	upload, err := bulkUploadReader(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Please upload a CSV file")
+	}
+	defer upload.Close()
+
+	rows, err := parseBulkCSV(upload)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Could not read the CSV file: "+err.Error())
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.Logger().Errorf("Could not start bulk creation transaction: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+	defer tx.Rollback()
+
+	for idx := range rows {
+		row := &rows[idx]
+		if row.Error != "" {
+			continue
+		}
+
+		link, err := buildBulkLink(tx, config, row, userId, domain)
+		if errors.Is(err, errBulkStorage) {
+			c.Logger().Errorf("Could not check links during bulk creation: %s", err.Error())
+			return c.String(http.StatusInternalServerError, "Internal server error")
+		} else if err != nil {
+			row.Error = err.Error()
+			continue
+		}
+
+		err = InsertLink(tx, link)
+		if err != nil {
+			c.Logger().Errorf("Could not add link to database during bulk creation: %s", err.Error())
+			return c.String(http.StatusInternalServerError, "Error adding links to database")
+		}
+		row.Shortcode = link.Shortcode
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("Could not commit bulk creation transaction: %s", err.Error())
+		return c.String(http.StatusInternalServerError, "Error adding links to database")
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="links-`+time.Now().Format("20060102-150405")+`.csv"`)
+	c.Response().WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(c.Response())
+	writer.Write([]string{"url", "alias", "tags", "expiry", "shortcode", "short_url", "error"})
+	for _, row := range rows {
+		short := ""
+		if row.Shortcode != "" {
+			short = ShortURL(config, domain, row.Shortcode)
+		}
+		writer.Write([]string{row.URL, row.Alias, row.Tags, row.Expiry, row.Shortcode, short, row.Error})
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
+
+/*
+* Function: bulkUploadReader
+*
+* Parameters: c echo.Context - The context of the request
+*
+* Returns: io.ReadCloser - The uploaded CSV data
+*          error         - If a multipart form was sent without a file
+*
+* Description: Returns the "file" field of a multipart form, or the request body for any other content type
+ */
+func bulkUploadReader(c echo.Context) (io.ReadCloser, error) {
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return c.Request().Body, nil
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+
+	return fileHeader.Open()
+}
+
+/*
+* Function: parseBulkCSV
+*
+* Parameters: r io.Reader - The CSV data
+*
+* Returns: []bulkRow - One entry per row of the CSV, excluding an optional header row
+*          error     - If the CSV is malformed or contains too many rows
+*
+* Description: Reads the url, alias, tags and expiry columns of each row. A first row whose first column is "url"
+*              is treated as a header and skipped
+ */
+func parseBulkCSV(r io.Reader) ([]bulkRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var rows []bulkRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rows) == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "url") {
+			continue
+		}
+
+		if len(rows) >= maxBulkRows {
+			return nil, errors.New("too many rows, the limit is 5000")
+		}
+
+		// Pad the record so the optional columns can always be read
+		for len(record) < 4 {
+			record = append(record, "")
+		}
+
+		row := bulkRow{
+			URL:    strings.TrimSpace(record[0]),
+			Alias:  strings.TrimSpace(record[1]),
+			Tags:   strings.TrimSpace(record[2]),
+			Expiry: strings.TrimSpace(record[3]),
+		}
+		if row.URL == "" {
+			row.Error = "missing url"
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Returned by buildBulkLink when the database could not be read, which fails the whole upload
+var errBulkStorage = errors.New("storage error")
+
+/*
+* Function: buildBulkLink
+*
+* Parameters: tx     *sql.Tx      - The transaction the links are being created in
+*             config *conf.Config - The configuration for the application
+*             row    *bulkRow     - The row to create a link for
+*             userId int          - The id of the user the link will belong to
+*             domain string       - The domain the link is created on, empty for the default host
+*
+* Returns: *globalstructs.Link - The link ready to be inserted
+*          error               - A message describing why the row is invalid, or errBulkStorage
+*
+* Description: Validates a row and fills out the link it describes, generating a shortcode unless an alias was given
+ */
+func buildBulkLink(tx *sql.Tx, config *conf.Config, row *bulkRow, userId int, domain string) (*globalstructs.Link, error) {
+	err := validateDestination(config, row.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	link := globalstructs.Link{Domain: domain, Url: row.URL, UserId: userId, Tags: ParseTags(row.Tags)}
+
+	if row.Expiry != "" {
+		link.ExpiresAt, err = ParseExpiry(row.Expiry, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if row.Alias == "" {
+		link.ID, link.Shortcode, err = GenUniqueID(tx, &config.Shortcodes)
+		if err != nil {
+			return nil, errors.Join(errBulkStorage, err)
+		}
+		return &link, nil
+	}
+
+	link.Shortcode, err = ValidateAlias(row.Alias, &config.Shortcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Aliases only need to be free on the domain the link is created on
+	_, err = GetLinkByShortcode(tx, domain, link.Shortcode)
+	if err == nil {
+		return nil, errors.New("alias is already in use")
+	} else if err != sql.ErrNoRows {
+		return nil, errors.Join(errBulkStorage, err)
+	}
+
+	// The alias still needs a unique id, the generated shortcode for it is discarded
+	link.ID, _, err = GenUniqueID(tx, &config.Shortcodes)
+	if err != nil {
+		return nil, errors.Join(errBulkStorage, err)
+	}
+
+	return &link, nil
+}
+
+/*
+* Function: ValidateAlias
+*
+* Parameters: alias  string           - The custom shortcode requested by the user
+*             config *conf.Shortcodes - The shortcode configuration
+*
+* Returns: string - The alias in the form it should be stored
+*          error  - A message describing why the alias cannot be used
+*
+* Description: Checks that an alias only contains url safe characters, does not clash with a route of the server
+*              and does not contain a denylisted word. The alias is converted to the case of the universe so
+*              that case-insensitive lookups find it
+ */
+func ValidateAlias(alias string, config *conf.Shortcodes) (string, error) {
+	if !aliasPattern.MatchString(alias) {
+		return "", errors.New("alias may only contain letters, numbers, - and _ and be at most 64 characters")
+	}
+
+	alias = codegen.NormalizeCase(alias, config.Universe)
+
+	for _, reserved := range reservedShortcodes {
+		if strings.EqualFold(alias, reserved) {
+			return "", errors.New("alias is reserved")
+		}
+	}
+
+	if codegen.ContainsDenied(alias, config.Denylist) {
+		return "", errors.New("alias contains a word that is not allowed")
+	}
+
+	return alias, nil
+}
+
+/*
+* Function: ParseExpiry
+*
+* Parameters: raw string    - The expiry as entered by the user
+*             now time.Time - The current time
+*
+* Returns: int64 - The unix time at which the link expires
+*          error - If the expiry could not be parsed or is in the past
+*
+* Description: Accepts an RFC 3339 timestamp, "YYYY-MM-DD HH:MM" in UTC or a plain "YYYY-MM-DD" date. A plain
+*              date keeps the link working until the end of that day in UTC
+ */
+func ParseExpiry(raw string, now time.Time) (int64, error) {
+	layouts := []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"}
+	for _, layout := range layouts {
+		expiry, err := time.Parse(layout, raw)
+		if err != nil {
+			continue
+		}
+
+		if layout == "2006-01-02" {
+			expiry = expiry.AddDate(0, 0, 1)
+		}
+
+		if !expiry.After(now) {
+			return 0, errors.New("expiry is in the past")
+		}
+
+		return expiry.Unix(), nil
+	}
+
+	return 0, errors.New("invalid expiry, use YYYY-MM-DD or an RFC 3339 timestamp")
+}
@@ -0,0 +1,234 @@
+/*
+* File: cmd/certs.go
+*
+* Description: This file contains where the TLS certificates of the server come from. They are either requested
+*              from an ACME certificate authority such as Let's Encrypt and kept in a cache directory, or read from
+*              auth.tls_cert and auth.tls_key and reloaded when those files change, so renewing them by hand does
+*              not need a restart
+*
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// How often the certificate files are checked for changes, at most once per handshake
+const certCheckInterval = 10 * time.Second
+
+// Where ACME certificates are kept when acme.cache_dir is not set
+const defaultACMECacheDir = "acme-cache"
+
+/*
+* Function: newACMEManager
+*
+* Parameters: config *conf.Config - The configuration for the application
+*
+* Returns: *autocert.Manager - The manager that requests and renews certificates, nil if ACME is not enabled
+*          error             - If the configuration cannot be used
+*
+* Description: Certificates are only requested for server.host and server.domains, so a client sending another
+*              name cannot make the server ask for certificates it does not need
+ */
+func newACMEManager(config *conf.Config) (*autocert.Manager, error) {
+	if !config.ACME.Enabled {
+		return nil, nil
+	}
+	if config.Server.PlainHTTP {
+		return nil, errors.New("acme.enabled cannot be used with server.plain_http, the proxy handles TLS")
+	}
+
+	cacheDir := config.ACME.CacheDir
+	if cacheDir == "" {
+		cacheDir = defaultACMECacheDir
+	}
+
+	client := &acme.Client{DirectoryURL: config.ACME.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	// Test certificate authorities such as Pebble serve their directory with a certificate from their own root
+	if config.ACME.CACert != "" {
+		pem, err := os.ReadFile(config.ACME.CACert)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.ACME.CACert)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(append([]string{config.Server.Host}, config.Server.Domains...)...),
+		Email:      config.ACME.Email,
+		Client:     client,
+	}, nil
+}
+
+/*
+* Struct: certReloader
+*
+* Description: Serves the certificate in a pair of files, loading it again after either file is modified. If the
+*              new files cannot be loaded, such as while they are half written, the previous certificate is kept
+ */
+type certReloader struct {
+	certFile string      // The path of the PEM certificate chain
+	keyFile  string      // The path of the PEM private key
+	logger   echo.Logger // Where reloads are reported
+
+	mu          sync.Mutex
+	cert        *tls.Certificate // The certificate currently served
+	certModTime time.Time        // The modification time of certFile when cert was loaded
+	keyModTime  time.Time        // The modification time of keyFile when cert was loaded
+	lastCheck   time.Time        // When the files were last checked for changes
+}
+
+/*
+* Function: newCertReloader
+*
+* Parameters: certFile string      - The path of the PEM certificate chain
+*             keyFile  string      - The path of the PEM private key
+*             logger   echo.Logger - Where reloads are reported
+*
+* Returns: *certReloader - The reloader, with the certificate loaded
+*          error         - If the certificate cannot be loaded
+*
+* Description: Loads the certificate once so a missing or broken file stops the server at startup
+ */
+func newCertReloader(certFile, keyFile string, logger echo.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/*
+* Function: certReloader.load
+*
+* Parameters: None
+*
+* Returns: error - If either file cannot be read or they do not hold a matching certificate and key
+*
+* Description: Reads the files and replaces the served certificate. Must be called with mu held or before the
+*              reloader is shared
+ */
+func (r *certReloader) load() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	r.lastCheck = time.Now()
+	return nil
+}
+
+/*
+* Function: certReloader.changed
+*
+* Parameters: None
+*
+* Returns: bool - true if either file was modified since the certificate was loaded
+*
+* Description: Compares the modification times of the files, must be called with mu held
+ */
+func (r *certReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certModTime) || !keyInfo.ModTime().Equal(r.keyModTime)
+}
+
+/*
+* Function: certReloader.GetCertificate
+*
+* Parameters: hello *tls.ClientHelloInfo - The handshake the certificate is for, unused
+*
+* Returns: *tls.Certificate - The current certificate
+*          error            - Never, a failed reload keeps the previous certificate
+*
+* Description: Used as tls.Config.GetCertificate. The files are checked at most once every certCheckInterval
+ */
+func (r *certReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) >= certCheckInterval {
+		r.lastCheck = time.Now()
+		if r.changed() {
+			// A failed load leaves the previous certificate in place, it is tried again after the next interval
+			err := r.load()
+			if err != nil {
+				r.logger.Errorf("Could not reload the TLS certificate, keeping the previous one. Error: %s", err.Error())
+			} else {
+				r.logger.Infof("Reloaded the TLS certificate from %s", r.certFile)
+			}
+		}
+	}
+
+	return r.cert, nil
+}
+
+/*
+* Function: newTLSConfig
+*
+* Parameters: e       *echo.Echo        - The web server, used for logging
+*             config  *conf.Config      - The configuration for the application
+*             manager *autocert.Manager - The ACME manager, nil to use the certificate files
+*
+* Returns: *tls.Config - The TLS configuration of the HTTPS listener
+*          error       - If the certificate files cannot be loaded
+*
+* Description: Builds the TLS configuration for whichever source of certificates is configured
+ */
+func newTLSConfig(e *echo.Echo, config *conf.Config, manager *autocert.Manager) (*tls.Config, error) {
+	if manager != nil {
+		e.Logger.Infof("Requesting certificates from %s", manager.Client.DirectoryURL)
+		return manager.TLSConfig(), nil
+	}
+
+	reloader, err := newCertReloader(config.Auth.TLSCert, config.Auth.TLSKey, e.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}, nil
+}
@@ -0,0 +1,700 @@
+/*
+* File: cmd/certs_test.go
+*
+* Description: Tests for where the TLS certificates come from. ACME is tested against fakeACME, an in-process
+*              stand-in for a certificate authority such as Pebble, and the certificate files are rewritten on disk
+*              to test reloading them
+*
+ */
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"golang.org/x/crypto/acme"
+)
+
+/*
+* Struct: fakeACME
+*
+* Description: A minimal ACME certificate authority. It follows the RFC 8555 order flow and offers only http-01
+*              challenges, which it validates by sending the request to the challenge handler directly instead of
+*              connecting to the domain. Signatures on requests are not checked
+ */
+type fakeACME struct {
+	server  *httptest.Server
+	caKey   *ecdsa.PrivateKey
+	caCert  *x509.Certificate
+	handler http.Handler // Answers http-01 challenges, the manager's HTTPHandler
+
+	mu         sync.Mutex
+	accountKey crypto.PublicKey
+	nonce      int
+	orders     []*fakeOrder
+}
+
+/*
+* Struct: fakeOrder
+*
+* Description: An order for one domain, it has a single authorization and challenge that share its index
+ */
+type fakeOrder struct {
+	domain string
+	token  string
+	authz  string // pending, valid or invalid
+	cert   []byte // The DER of the issued certificate, nil until the order is finalized
+}
+
+/*
+* Struct: jwsRequest
+*
+* Description: The parts of a signed ACME request that the fake reads
+ */
+type jwsRequest struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+}
+
+/*
+* Function: newFakeACME
+*
+* Parameters: t *testing.T - The test the authority belongs to
+*
+* Returns: *fakeACME - A running authority, closed when the test ends
+*
+* Description: Starts the authority over HTTPS with a certificate of its own, as Pebble does
+ */
+func newFakeACME(t *testing.T) *fakeACME {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &fakeACME{caKey: key, caCert: caCert}
+	ca.server = httptest.NewTLSServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.server.Close)
+	return ca
+}
+
+/*
+* Function: fakeACME.writeRoot
+*
+* Parameters: t *testing.T - The test the file belongs to
+*
+* Returns: string - The path of a PEM file holding the certificate the authority serves its directory with
+*
+* Description: Used as acme.ca_cert so the client trusts the authority
+ */
+func (ca *fakeACME) writeRoot(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "fake-acme-root.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: ca.server.Certificate().Raw}
+	err := os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/*
+* Function: fakeACME.orderedDomains
+*
+* Parameters: None
+*
+* Returns: []string - The domain of every order made, in order
+*
+* Description: Lets tests check which certificates were asked for
+ */
+func (ca *fakeACME) orderedDomains() []string {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	var domains []string
+	for _, order := range ca.orders {
+		domains = append(domains, order.domain)
+	}
+	return domains
+}
+
+/*
+* Function: fakeACME.serve
+*
+* Parameters: w http.ResponseWriter - The response
+*             r *http.Request       - A request from the ACME client
+*
+* Returns: None
+*
+* Description: Routes the requests of the order flow. Every response carries a new nonce
+ */
+func (ca *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", ca.nonce))
+	base := ca.server.URL
+
+	if r.URL.Path == "/dir" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   base + "/nonce",
+			"newAccount": base + "/account",
+			"newOrder":   base + "/order",
+			"revokeCert": base + "/revoke",
+			"keyChange":  base + "/key-change",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var req jwsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if r.Method != http.MethodPost || err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(req.Payload)
+
+	// Everything after the account is addressed by the index of its order
+	var kind string
+	var index int
+	fmt.Sscanf(strings.ReplaceAll(strings.TrimPrefix(r.URL.Path, "/"), "/", " "), "%s %d", &kind, &index)
+	var order *fakeOrder
+	if index > 0 && index <= len(ca.orders) {
+		order = ca.orders[index-1]
+	}
+
+	switch {
+	case kind == "account":
+		protected, _ := base64.RawURLEncoding.DecodeString(req.Protected)
+		var header struct {
+			JWK json.RawMessage `json:"jwk"`
+		}
+		json.Unmarshal(protected, &header)
+		ca.accountKey, err = parseJWK(header.JWK)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", base+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case kind == "order" && index == 0:
+		var newOrder struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &newOrder)
+		if len(newOrder.Identifiers) != 1 {
+			http.Error(w, "one identifier expected", http.StatusBadRequest)
+			return
+		}
+		order = &fakeOrder{domain: newOrder.Identifiers[0].Value, authz: acme.StatusPending}
+		ca.orders = append(ca.orders, order)
+		order.token = fmt.Sprintf("token-%d", len(ca.orders))
+		ca.writeOrder(w, http.StatusCreated, len(ca.orders))
+	case order == nil:
+		http.NotFound(w, r)
+	case kind == "order":
+		ca.writeOrder(w, http.StatusOK, index)
+	case kind == "authz":
+		ca.writeAuthz(w, index)
+	case kind == "chal":
+		if string(payload) == "{}" {
+			ca.validate(order)
+		}
+		writeJSON(w, http.StatusOK, ca.challenge(index))
+	case kind == "finalize":
+		ca.finalize(w, payload, index)
+	case kind == "cert" && order.cert != nil:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: order.cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+/*
+* Function: fakeACME.writeOrder
+*
+* Parameters: w      http.ResponseWriter - The response
+*             status int                 - The http status to respond with
+*             index  int                 - The index of the order
+*
+* Returns: None
+*
+* Description: Writes an order, which is ready once its authorization is valid and valid once it has a certificate
+ */
+func (ca *fakeACME) writeOrder(w http.ResponseWriter, status int, index int) {
+	order := ca.orders[index-1]
+	base := ca.server.URL
+
+	body := map[string]interface{}{
+		"status":         acme.StatusPending,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.domain}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", base, index)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", base, index),
+	}
+	switch {
+	case order.cert != nil:
+		body["status"] = acme.StatusValid
+		body["certificate"] = fmt.Sprintf("%s/cert/%d", base, index)
+	case order.authz == acme.StatusValid:
+		body["status"] = acme.StatusReady
+	case order.authz == acme.StatusInvalid:
+		body["status"] = acme.StatusInvalid
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", base, index))
+	writeJSON(w, status, body)
+}
+
+/*
+* Function: fakeACME.writeAuthz
+*
+* Parameters: w     http.ResponseWriter - The response
+*             index int                 - The index of the order the authorization belongs to
+*
+* Returns: None
+*
+* Description: Writes an authorization offering a single http-01 challenge
+ */
+func (ca *fakeACME) writeAuthz(w http.ResponseWriter, index int) {
+	order := ca.orders[index-1]
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     order.authz,
+		"identifier": map[string]string{"type": "dns", "value": order.domain},
+		"challenges": []interface{}{ca.challenge(index)},
+	})
+}
+
+/*
+* Function: fakeACME.challenge
+*
+* Parameters: index int - The index of the order the challenge belongs to
+*
+* Returns: map[string]string - The challenge as it is sent to the client
+*
+* Description: Describes the http-01 challenge of an order
+ */
+func (ca *fakeACME) challenge(index int) map[string]string {
+	order := ca.orders[index-1]
+	return map[string]string{
+		"type":   "http-01",
+		"url":    fmt.Sprintf("%s/chal/%d", ca.server.URL, index),
+		"token":  order.token,
+		"status": order.authz,
+	}
+}
+
+/*
+* Function: fakeACME.validate
+*
+* Parameters: order *fakeOrder - The order whose challenge the client says is ready
+*
+* Returns: None
+*
+* Description: Asks the challenge handler for the token as the authority would over port 80, and checks that it
+*              answers with the key authorization of the account
+ */
+func (ca *fakeACME) validate(order *fakeOrder) {
+	order.authz = acme.StatusInvalid
+	if ca.handler == nil || ca.accountKey == nil {
+		return
+	}
+
+	thumbprint, err := acme.JWKThumbprint(ca.accountKey)
+	if err != nil {
+		return
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://"+order.domain+"/.well-known/acme-challenge/"+order.token, nil)
+	recorder := httptest.NewRecorder()
+	ca.handler.ServeHTTP(recorder, req)
+
+	if recorder.Code == http.StatusOK && recorder.Body.String() == order.token+"."+thumbprint {
+		order.authz = acme.StatusValid
+	}
+}
+
+/*
+* Function: fakeACME.finalize
+*
+* Parameters: w       http.ResponseWriter - The response
+*             payload []byte              - The finalize request holding the CSR
+*             index   int                 - The index of the order
+*
+* Returns: None
+*
+* Description: Issues a certificate for the CSR of a ready order, signed by the authority's root
+ */
+func (ca *fakeACME) finalize(w http.ResponseWriter, payload []byte, index int) {
+	order := ca.orders[index-1]
+	if order.authz != acme.StatusValid {
+		http.Error(w, "order is not ready", http.StatusForbidden)
+		return
+	}
+
+	var finalize struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(payload, &finalize)
+	der, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != order.domain {
+		http.Error(w, "bad csr", http.StatusBadRequest)
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(index + 1)),
+		Subject:      pkix.Name{CommonName: order.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	order.cert, err = x509.CreateCertificate(rand.Reader, template, ca.caCert, csr.PublicKey, ca.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ca.writeOrder(w, http.StatusOK, index)
+}
+
+/*
+* Function: parseJWK
+*
+* Parameters: raw json.RawMessage - The jwk of a signed request
+*
+* Returns: crypto.PublicKey - The account's public key
+*          error            - If the key is not a P-256 key, which is what autocert creates
+*
+* Description: Reads the account key so the key authorization of a challenge can be checked
+ */
+func parseJWK(raw json.RawMessage) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty, Crv, X, Y string
+	}
+	err := json.Unmarshal(raw, &jwk)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Kty != "EC" || jwk.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported account key %s %s", jwk.Kty, jwk.Crv)
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+/*
+* Function: writeJSON
+*
+* Parameters: w      http.ResponseWriter - The response
+*             status int                 - The http status to respond with
+*             body   interface{}         - The value to encode
+*
+* Returns: None
+*
+* Description: Writes a JSON response
+ */
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+/*
+* Function: newACMETestConfig
+*
+* Parameters: t  *testing.T - The test the configuration belongs to
+*             ca *fakeACME  - The authority to use
+*
+* Returns: *conf.Config - A configuration with ACME enabled against the fake authority
+*
+* Description: The default host and one branded domain are the only names certificates may be requested for
+ */
+func newACMETestConfig(t *testing.T, ca *fakeACME) *conf.Config {
+	config := &conf.Config{}
+	config.Server.Host = "links.example.test"
+	config.Server.Domains = []string{"go.brand.test"}
+	config.ACME = conf.ACME{
+		Enabled:      true,
+		Email:        "admin@example.test",
+		CacheDir:     t.TempDir(),
+		DirectoryURL: ca.server.URL + "/dir",
+		CACert:       ca.writeRoot(t),
+	}
+	return config
+}
+
+func TestACMEManagerIssuesCertificates(t *testing.T) {
+	ca := newFakeACME(t)
+	config := newACMETestConfig(t, ca)
+
+	manager, err := newACMEManager(config)
+	if err != nil {
+		t.Fatalf("newACMEManager returned an error: %s", err)
+	}
+	// The redirect listener wraps its handler the same way, which is what enables http-01
+	ca.mu.Lock()
+	ca.handler = manager.HTTPHandler(nil)
+	ca.mu.Unlock()
+
+	for _, host := range []string{"links.example.test", "go.brand.test"} {
+		hello := &tls.ClientHelloInfo{
+			ServerName:   host,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+		cert, err := manager.GetCertificate(hello)
+		if err != nil {
+			t.Fatalf("GetCertificate(%s) returned an error: %s", host, err)
+		}
+
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cert.Leaf.VerifyHostname(host); err != nil {
+			t.Errorf("The certificate for %s does not cover it: %s", host, err)
+		}
+		if err := cert.Leaf.CheckSignatureFrom(ca.caCert); err != nil {
+			t.Errorf("The certificate for %s was not issued by the fake authority: %s", host, err)
+		}
+	}
+
+	// A name that is not configured is refused without asking the authority
+	_, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.test"})
+	if err == nil {
+		t.Error("GetCertificate returned a certificate for a host that is not configured")
+	}
+
+	want := []string{"links.example.test", "go.brand.test"}
+	if got := ca.orderedDomains(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Orders were made for %v, want %v", got, want)
+	}
+}
+
+func TestACMEManagerConfiguration(t *testing.T) {
+	config := &conf.Config{}
+	manager, err := newACMEManager(config)
+	if manager != nil || err != nil {
+		t.Errorf("newACMEManager with ACME disabled = %v, %v, want nil, nil", manager, err)
+	}
+
+	config.ACME.Enabled = true
+	config.Server.PlainHTTP = true
+	_, err = newACMEManager(config)
+	if err == nil {
+		t.Error("newACMEManager accepted ACME together with server.plain_http")
+	}
+
+	config.Server.PlainHTTP = false
+	config.ACME.CACert = filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(config.ACME.CACert, []byte("not a certificate"), 0600)
+	_, err = newACMEManager(config)
+	if err == nil {
+		t.Error("newACMEManager accepted an acme.ca_cert without certificates")
+	}
+}
+
+/*
+* Function: writeKeyPair
+*
+* Parameters: t        *testing.T - The test the files belong to
+*             certFile string     - Where to write the certificate
+*             keyFile  string     - Where to write the key
+*             name     string     - The common name of the certificate, used to tell certificates apart
+*             modTime  time.Time  - The modification time given to both files
+*
+* Returns: None
+*
+* Description: Writes a new self-signed certificate and its key. The modification time is set explicitly because
+*              files written in quick succession can share one on coarse filesystems
+ */
+func writeKeyPair(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	touch(t, modTime, certFile, keyFile)
+}
+
+/*
+* Function: touch
+*
+* Parameters: t       *testing.T  - The test the files belong to
+*             modTime time.Time   - The modification time to set
+*             files   ...string   - The files to change
+*
+* Returns: None
+*
+* Description: Sets the modification time of files
+ */
+func touch(t *testing.T, modTime time.Time, files ...string) {
+	t.Helper()
+	for _, file := range files {
+		err := os.Chtimes(file, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+/*
+* Function: servedName
+*
+* Parameters: t        *testing.T    - The test
+*             reloader *certReloader - The reloader to ask
+*
+* Returns: string - The common name of the certificate the reloader serves
+*
+* Description: Performs the lookup a handshake would
+ */
+func servedName(t *testing.T, reloader *certReloader) string {
+	t.Helper()
+
+	cert, err := reloader.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("GetCertificate returned an error: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeKeyPair(t, certFile, keyFile, "first", start)
+
+	logger := echo.New().Logger
+	logger.SetOutput(io.Discard)
+	reloader, err := newCertReloader(certFile, keyFile, logger)
+	if err != nil {
+		t.Fatalf("newCertReloader returned an error: %s", err)
+	}
+	if name := servedName(t, reloader); name != "first" {
+		t.Fatalf("Serving %q, want %q", name, "first")
+	}
+
+	// Changes are only looked for once the check interval has passed
+	writeKeyPair(t, certFile, keyFile, "second", start.Add(time.Minute))
+	if name := servedName(t, reloader); name != "first" {
+		t.Errorf("Serving %q before the check interval passed, want %q", name, "first")
+	}
+
+	reloader.lastCheck = time.Now().Add(-certCheckInterval)
+	if name := servedName(t, reloader); name != "second" {
+		t.Errorf("Serving %q after the files changed, want %q", name, "second")
+	}
+
+	// A half written or broken certificate keeps the previous one in place
+	err = os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\ntruncated"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	touch(t, start.Add(2*time.Minute), certFile)
+	reloader.lastCheck = time.Now().Add(-certCheckInterval)
+	if name := servedName(t, reloader); name != "second" {
+		t.Errorf("Serving %q after a broken certificate was written, want %q", name, "second")
+	}
+
+	// Once the files are fixed the new certificate is picked up on a later check
+	writeKeyPair(t, certFile, keyFile, "third", start.Add(3*time.Minute))
+	reloader.lastCheck = time.Now().Add(-certCheckInterval)
+	if name := servedName(t, reloader); name != "third" {
+		t.Errorf("Serving %q after the files were fixed, want %q", name, "third")
+	}
+}
+
+func TestCertReloaderRequiresFilesAtStartup(t *testing.T) {
+	dir := t.TempDir()
+	_, err := newCertReloader(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing-key.pem"), echo.New().Logger)
+	if err == nil {
+		t.Error("newCertReloader accepted files that do not exist")
+	}
+}
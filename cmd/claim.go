@@ -0,0 +1,200 @@
+/*
+* File: cmd/claim.go
+*
+* Description: This file contains the handlers that let a user who created a link while logged out move it into
+*              their account with the one-time claim link they were given, for example right after registering
+*
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+	"github.com/vtallen/go-link-shortener/internal/sessmngt"
+)
+
+/*
+* Function: NewClaimToken
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the anonymous link the token is for
+*
+* Returns: string - The token to give to the creator of the link
+*          error  - Any error that occurred generating or storing the token
+*
+* Description: Generates a random claim token for a link. Only a hash of the token is stored, so the database
+*              cannot be used to claim links
+ */
+func NewClaimToken(db *sql.DB, linkId int) (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	err = SetLinkClaimToken(db, linkId, HashClaimToken(token))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+/*
+* Function: HashClaimToken
+*
+* Parameters: token string - A claim token as given to the creator of a link
+*
+* Returns: string - The hex encoded SHA-256 hash of the token
+*
+* Description: Hashes a claim token into the form it is stored in the database
+ */
+func HashClaimToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+* Function: findClaimableLink
+*
+* Parameters: c      echo.Context - The context of the request
+*             db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*             token  string       - The claim token from the request
+*
+* Returns: *globalstructs.Link - The link the token claims, nil if an error page has been rendered
+*          error               - Any error from rendering the error page
+*
+* Description: Looks up the link for a claim token, rendering an error page if the token is unknown, has already
+*              been used or the claim window has passed
+ */
+func findClaimableLink(c echo.Context, db *sql.DB, config *conf.Config, token string) (*globalstructs.Link, error) {
+	if config.Cleanup.ClaimWindowMinutes <= 0 || token == "" {
+		return nil, c.Render(http.StatusNotFound, "error-page", globalstructs.ErrorPageData{ErrorText: "This claim link is not valid"})
+	}
+
+	link, err := GetLinkByClaimToken(db, HashClaimToken(token))
+	if err == sql.ErrNoRows {
+		return nil, c.Render(http.StatusNotFound, "error-page", globalstructs.ErrorPageData{ErrorText: "This claim link is not valid or has already been used"})
+	} else if err != nil {
+		c.Logger().Errorf("Could not look up claim token: %s", err.Error())
+		return nil, c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	window := time.Duration(config.Cleanup.ClaimWindowMinutes) * time.Minute
+	if time.Since(time.Unix(link.CreatedAt, 0)) > window {
+		return nil, c.Render(http.StatusGone, "error-page", globalstructs.ErrorPageData{ErrorText: "This claim link has expired"})
+	}
+
+	return link, nil
+}
+
+/*
+* Function: HandleClaimPage
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error rendering the page
+*
+* Description: Handles a GET request to /claim?token=. Logged in users are shown a button to claim the link. Other
+*              users are asked to log in or register, and are brought back to this page once they have logged in
+*
+ */
+func HandleClaimPage(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	token := c.QueryParam("token")
+	link, err := findClaimableLink(c, db, config, token)
+	if link == nil {
+		return err
+	}
+
+	data := globalstructs.ClaimPageData{
+		Token:      token,
+		ShortURL:   ShortURL(config, link.Domain, link.Shortcode),
+		Url:        link.Url,
+		IsLoggedIn: sessmngt.ValidateSession(c) == nil,
+	}
+
+	if !data.IsLoggedIn {
+		sess, err := session.Get("session", c)
+		if err != nil {
+			c.Logger().Errorf("Could not get session from context: %s\n", err.Error())
+			return c.String(http.StatusInternalServerError, "Internal server error")
+		}
+
+		sessmngt.SetReturnTo(sess, "/claim?token="+url.QueryEscape(token))
+		if err := sess.Save(c.Request(), c.Response()); err != nil {
+			c.Logger().Errorf("Could not save session: %s\n", err.Error())
+			return c.String(http.StatusInternalServerError, "Internal server error")
+		}
+	}
+
+	return c.Render(http.StatusOK, "claim", data)
+}
+
+/*
+* Function: HandleClaimLink
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error claiming the link or rendering the response
+*
+* Description: Handles a POST request to /claim from the claim page, moving the link into the logged in user's
+*              account and using up the token
+*
+ */
+func HandleClaimLink(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	sess, err := session.Get("session", c)
+	if err != nil {
+		c.Logger().Errorf("Could not get session from context: %s\n", err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	userId, ok := sess.Values["userId"].(int)
+	if !ok {
+		c.Logger().Errorf("Could not convert the session userId to int.\n")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	token := c.FormValue("token")
+	link, err := findClaimableLink(c, db, config, token)
+	if link == nil {
+		return err
+	}
+
+	err = ClaimLink(db, HashClaimToken(token), userId)
+	if err == sql.ErrNoRows {
+		return c.Render(http.StatusNotFound, "error-page", globalstructs.ErrorPageData{ErrorText: "This claim link has already been used"})
+	} else if err != nil {
+		c.Logger().Errorf("Could not claim link id %d for user id %d: %s", link.ID, userId, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return c.Redirect(http.StatusSeeOther, "/user")
+}
@@ -0,0 +1,428 @@
+/*
+* File: cmd/commands.go
+*
+* Description: This file contains the dispatcher for the commands that can be run with the server binary instead of
+*              starting the web server, e.g. ./server backup shortener-backup.db, along with the backup commands
+*
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vtallen/go-link-shortener/internal/conf"
+)
+
+// The version of the JSON dump format written by dump and accepted by restore
+const dumpVersion = 1
+
+// The tables included in a JSON dump, in the order they are restored
+var dumpTables = []string{"users", "links", "sessions", "daily_clicks", "link_rules", "link_variants"}
+
+/*
+* Struct: databaseDump
+*
+* Description: A portable copy of the database. Each table is a list of rows keyed by column name so that a dump
+*              can be restored into a database created by a newer version of the server
+ */
+type databaseDump struct {
+	Version   int                                 `json:"version"`
+	CreatedAt string                              `json:"created_at"`
+	Tables    map[string][]map[string]interface{} `json:"tables"`
+}
+
+/*
+* Function: RunCommand
+*
+* Parameters: args   []string     - The command line arguments after the program name
+*             db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*
+* Returns: int - The exit code for the program
+*
+* Description: Runs the maintenance command named by the first argument
+ */
+func RunCommand(args []string, db *sql.DB, config *conf.Config) int {
+	var err error
+	switch args[0] {
+	case "backup":
+		err = runBackup(db, args[1:])
+	case "dump":
+		err = runDump(db, args[1:])
+	case "restore":
+		err = runRestore(db, args[1:])
+	case "user":
+		err = runUserCommand(db, args[1:])
+	case "links":
+		err = runLinksCommand(db, config, args[1:])
+	case "sessions":
+		err = runSessionsCommand(db, args[1:])
+	case "help", "-h", "-help", "--help":
+		printUsage(os.Stdout)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+/*
+* Function: printUsage
+*
+* Parameters: w io.Writer - Where to write the usage text
+*
+* Returns: None
+*
+* Description: Prints the list of available commands
+ */
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, `Usage: server [-config config.yaml] [command]
+
+Starts the web server when no command is given.
+
+Commands:
+  backup <file>                   Write a consistent copy of the sqlite database to file while the server is running
+  dump <file>                     Write a portable JSON dump of users, links and sessions to file, use - for stdout
+  restore [-force] <file>         Replace the contents of the database with a JSON dump, use - for stdin
+
+  user add [-admin] <email>       Create a user, the password is read from standard input
+  user passwd <email>             Reset a user's password, read from standard input, and log them out
+  user promote <email>            Give a user admin permissions
+  user demote <email>             Take admin permissions away from a user
+  user remove [-links] <email>    Remove a user and their sessions, -links also deletes their links
+  user list                       List every user
+
+  links list [-user <email>]      List every link, or only the links of one user
+  links delete <shortcode|id>...  Delete links, use domain/shortcode for links on one of server.domains
+  links prune -days <n> [-dry-run]
+                                  Delete links that have not been created or clicked in n days
+
+  sessions purge [-expired]       Delete every session, or only the expired ones
+`)
+}
+
+/*
+* Function: runBackup
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given to the command
+*
+* Returns: error - Any error that occurred while writing the backup
+*
+* Description: Uses VACUUM INTO to copy the database into a new file. The copy is made inside a read transaction
+*              so it is consistent even while the server is handling requests
+ */
+func runBackup(db *sql.DB, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: backup <file>")
+	}
+
+	// VACUUM INTO refuses to overwrite an existing database, check first to give a clearer error
+	if _, err := os.Stat(args[0]); err == nil {
+		return errors.New(args[0] + " already exists")
+	}
+
+	_, err := db.Exec("VACUUM INTO ?", args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backed up database to %s\n", args[0])
+	return nil
+}
+
+/*
+* Function: runDump
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given to the command
+*
+* Returns: error - Any error that occurred while reading the database or writing the dump
+*
+* Description: Writes every row of the tables in dumpTables to a JSON file. All tables are read in one
+*              transaction so the dump is consistent
+ */
+func runDump(db *sql.DB, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: dump <file>")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dump := databaseDump{
+		Version:   dumpVersion,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Tables:    make(map[string][]map[string]interface{}),
+	}
+
+	for _, table := range dumpTables {
+		rows, err := dumpTable(tx, table)
+		if err != nil {
+			return fmt.Errorf("reading table %s: %w", table, err)
+		}
+		dump.Tables[table] = rows
+	}
+
+	var out io.Writer = os.Stdout
+	if args[0] != "-" {
+		file, err := os.OpenFile(args[0], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(dump)
+	if err != nil {
+		return err
+	}
+
+	if args[0] != "-" {
+		fmt.Printf("Dumped database to %s\n", args[0])
+	}
+	return nil
+}
+
+/*
+* Function: dumpTable
+*
+* Parameters: tx    *sql.Tx - The transaction to read the table in
+*             table string  - The name of the table
+*
+* Returns: []map[string]interface{} - Every row of the table keyed by column name
+*          error                    - Any error that occurred while reading the table
+*
+* Description: Reads every row and column of a table without needing to know its schema
+ */
+func dumpTable(tx *sql.Tx, table string) ([]map[string]interface{}, error) {
+	rows, err := tx.Query("SELECT * FROM " + table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for idx := range values {
+			pointers[idx] = &values[idx]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for idx, column := range columns {
+			// Text may be returned as bytes, which would otherwise be encoded as base64
+			if b, ok := values[idx].([]byte); ok {
+				values[idx] = string(b)
+			}
+			row[column] = values[idx]
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+/*
+* Function: runRestore
+*
+* Parameters: db   *sql.DB  - A pointer to the database object
+*             args []string - The arguments given to the command
+*
+* Returns: error - Any error that occurred while reading the dump or writing the database
+*
+* Description: Replaces the contents of the tables in dumpTables with the rows of a JSON dump. Everything happens
+*              in one transaction, so a failed restore leaves the database untouched. Columns in the dump that
+*              the database does not have are ignored. Unless -force is given, the restore is refused if the
+*              database already has users or links
+ */
+func runRestore(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := flags.Bool("force", false, "Replace the contents of a database that is not empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: restore [-force] <file>")
+	}
+
+	var in io.Reader = os.Stdin
+	if flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	// Numbers are kept as json.Number so that large ids are not rounded by float64
+	var dump databaseDump
+	decoder := json.NewDecoder(in)
+	decoder.UseNumber()
+	if err := decoder.Decode(&dump); err != nil {
+		return fmt.Errorf("reading dump: %w", err)
+	}
+	if dump.Version != dumpVersion {
+		return fmt.Errorf("unsupported dump version %d", dump.Version)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if !*force {
+		var count int
+		err = tx.QueryRow("SELECT (SELECT COUNT(*) FROM users) + (SELECT COUNT(*) FROM links)").Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errors.New("the database is not empty, use -force to replace its contents")
+		}
+	}
+
+	for _, table := range dumpTables {
+		restored, err := restoreTable(tx, table, dump.Tables[table])
+		if err != nil {
+			return fmt.Errorf("restoring table %s: %w", table, err)
+		}
+		fmt.Printf("Restored %d rows into %s\n", restored, table)
+	}
+
+	return tx.Commit()
+}
+
+/*
+* Function: restoreTable
+*
+* Parameters: tx    *sql.Tx                  - The transaction the restore is running in
+*             table string                   - The name of the table
+*             rows  []map[string]interface{} - The rows from the dump
+*
+* Returns: int   - The number of rows inserted
+*          error - Any error that occurred while writing the table
+*
+* Description: Deletes every row of the table then inserts the rows from the dump
+ */
+func restoreTable(tx *sql.Tx, table string, rows []map[string]interface{}) (int, error) {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("DELETE FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, row := range rows {
+		var names []string
+		var values []interface{}
+		for name, value := range row {
+			if !columns[name] {
+				continue
+			}
+			if number, ok := value.(json.Number); ok {
+				value = jsonNumberValue(number)
+			}
+			names = append(names, name)
+			values = append(values, value)
+		}
+		if len(names) == 0 {
+			continue
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+		_, err = tx.Exec("INSERT INTO "+table+" ("+strings.Join(names, ", ")+") VALUES ("+placeholders+")", values...)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(rows), nil
+}
+
+/*
+* Function: tableColumns
+*
+* Parameters: tx    *sql.Tx - The transaction to read the schema in
+*             table string  - The name of the table
+*
+* Returns: map[string]bool - The set of column names of the table
+*          error           - Any error that occurred while reading the schema
+*
+* Description: Reads the names of a table's columns from sqlite
+ */
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
+}
+
+/*
+* Function: jsonNumberValue
+*
+* Parameters: number json.Number - A number read from a dump
+*
+* Returns: interface{} - The number as an int64 if it is a whole number, otherwise a float64
+*
+* Description: Converts numbers from a dump back into the types sqlite stored them as
+ */
+func jsonNumberValue(number json.Number) interface{} {
+	if integer, err := number.Int64(); err == nil {
+		return integer
+	}
+	if float, err := number.Float64(); err == nil {
+		return float
+	}
+	return number.String()
+}
@@ -9,14 +9,21 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/vtallen/go-link-shortener/internal/conf"
 	"github.com/vtallen/go-link-shortener/internal/globalstructs"
 
 	"github.com/labstack/echo/v4"
 	"github.com/vtallen/go-link-shortener/internal/sessmngt"
 	"github.com/vtallen/go-link-shortener/pkg/codegen"
+	"github.com/vtallen/go-link-shortener/pkg/urlutil"
 )
 
 /*
@@ -32,6 +39,13 @@ import (
 *
  */
 func SetupDB(db *sql.DB, e *echo.Echo) {
+	// In WAL mode readers do not block writers, so a slow export does not stop clicks from being counted.
+	// The mode is stored in the database file, so this only changes it the first time
+	_, err := db.Exec("PRAGMA journal_mode=WAL")
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed enabling WAL mode. Error: %s", err.Error())
+	}
+
 	// Create the links table if it doesn't exist
 	statement, err := db.Prepare("CREATE TABLE IF NOT EXISTS links (id INTEGER PRIMARY KEY, shortcode TEXT, url TEXT, userId INTEGER, clicks INTEGER DEFAULT 0)")
 	if err != nil {
@@ -51,175 +65,1136 @@ func SetupDB(db *sql.DB, e *echo.Echo) {
 		e.Logger.Fatalf("DB setup failed on table users. Error: %s", err.Error())
 	}
 
-	// sessId given as TEXT as a gorilla sessions session id is a string
-	statement, err = db.Prepare("CREATE TABLE IF NOT EXISTS sessions (sessId INTEGER PRIMARY KEY, expiryTimeUnix INTEGER NOT NULL, userId INTEGER NOT NULL)")
+	// sessId given as TEXT as a gorilla sessions session id is a string
+	statement, err = db.Prepare("CREATE TABLE IF NOT EXISTS sessions (sessId INTEGER PRIMARY KEY, expiryTimeUnix INTEGER NOT NULL, userId INTEGER NOT NULL)")
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed on table sessions. Error: %s", err.Error())
+	}
+	_, err = statement.Exec()
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed on table sessions. Error: %s", err.Error())
+	}
+
+	// Holds the number of clicks each link received on each day (UTC), day is formatted as YYYY-MM-DD
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS daily_clicks (linkId INTEGER NOT NULL, day TEXT NOT NULL, clicks INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (linkId, day))")
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed on table daily_clicks. Error: %s", err.Error())
+	}
+
+	// Holds the redirect rules of links, checked in order of position
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS link_rules (id INTEGER PRIMARY KEY AUTOINCREMENT, linkId INTEGER NOT NULL, position INTEGER NOT NULL, kind TEXT NOT NULL, value TEXT NOT NULL, url TEXT NOT NULL, clicks INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed on table link_rules. Error: %s", err.Error())
+	}
+
+	// Holds the destinations links split their traffic between
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS link_variants (id INTEGER PRIMARY KEY AUTOINCREMENT, linkId INTEGER NOT NULL, url TEXT NOT NULL, weight INTEGER NOT NULL DEFAULT 1, clicks INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed on table link_variants. Error: %s", err.Error())
+	}
+
+	// Bring the links table of older databases up to date
+	for _, migration := range linkMigrations {
+		err = addColumnIfMissing(db, "links", migration.Name, migration.Definition)
+		if err != nil {
+			e.Logger.Fatalf("DB setup failed adding column %s to table links. Error: %s", migration.Name, err.Error())
+		}
+	}
+
+	err = backfillNormalizedURLs(db)
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed filling in normalized urls. Error: %s", err.Error())
+	}
+
+	// Used to find an existing link for the same url when a user submits it again
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_links_user_url ON links (userId, normalized_url)")
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed on index idx_links_user_url. Error: %s", err.Error())
+	}
+
+	// Links are looked up by their shortcode when redirecting, which also covers custom aliases
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_links_shortcode ON links (shortcode)")
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed on index idx_links_shortcode. Error: %s", err.Error())
+	}
+
+	// Each domain has its own shortcodes, redirects look a shortcode up within the domain it was requested on
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_links_domain_shortcode ON links (domain, shortcode)")
+	if err != nil {
+		e.Logger.Fatalf("DB setup failed on index idx_links_domain_shortcode. Error: %s", err.Error())
+	}
+
+	// Used to page through a user's links in each of the orders the user page can be sorted in
+	for _, index := range []string{"idx_links_user_created ON links (userId, created_at)", "idx_links_user_clicks ON links (userId, clicks)", "idx_links_user_shortcode ON links (userId, shortcode)", "idx_links_claim_token ON links (claim_token) WHERE claim_token != ''", "idx_link_rules_link ON link_rules (linkId, position)", "idx_link_variants_link ON link_variants (linkId)"} {
+		_, err = db.Exec("CREATE INDEX IF NOT EXISTS " + index)
+		if err != nil {
+			e.Logger.Fatalf("DB setup failed on index %s. Error: %s", index, err.Error())
+		}
+	}
+}
+
+/*
+* Struct: columnMigration
+*
+* Description: Describes a column that was added to a table after the table was first created
+ */
+type columnMigration struct {
+	Name       string // The name of the column
+	Definition string // The type and constraints of the column as written in an ALTER TABLE statement
+}
+
+// Columns that have been added to the links table since it was first created. SetupDB adds any that are
+// missing so that databases created by older versions keep working
+var linkMigrations = []columnMigration{
+	{Name: "normalized_url", Definition: "TEXT"},
+	{Name: "tags", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "expires_at", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Name: "created_at", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Name: "title", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "description", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "last_clicked_at", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Name: "claim_token", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "meta_title", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "meta_description", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "meta_favicon", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "meta_fetched_at", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Name: "og_title", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "og_description", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "og_image", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "password_hash", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "sticky_variants", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Name: "passthrough_mode", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "utm_source", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "utm_medium", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "utm_campaign", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "prefix_mode", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Name: "fallback_url", Definition: "TEXT NOT NULL DEFAULT ''"},
+	{Name: "domain", Definition: "TEXT NOT NULL DEFAULT ''"},
+}
+
+/*
+* Function: addColumnIfMissing
+*
+* Parameters: db         *sql.DB - A pointer to the database object
+*             table      string  - The table to add the column to
+*             column     string  - The name of the column
+*             definition string  - The type and constraints of the column
+*
+* Returns: error - Any error that occurred while inspecting or altering the table
+*
+* Description: Adds a column to a table unless a column with that name already exists
+ */
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		err = rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+/*
+* Function: backfillNormalizedURLs
+*
+* Parameters: db *sql.DB - A pointer to the database object
+*
+* Returns: error - Any error that occurred while updating the links
+*
+* Description: Fills in the normalized_url column for links that were created before the column existed
+ */
+func backfillNormalizedURLs(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, url FROM links WHERE normalized_url IS NULL")
+	if err != nil {
+		return err
+	}
+
+	// Read everything first, sqlite will not allow the update while the select is still open
+	var links []globalstructs.Link
+	for rows.Next() {
+		var link globalstructs.Link
+		if err := rows.Scan(&link.ID, &link.Url); err != nil {
+			rows.Close()
+			return err
+		}
+		links = append(links, link)
+	}
+	rows.Close()
+
+	for _, link := range links {
+		_, err = db.Exec("UPDATE links SET normalized_url = ? WHERE id = ?", urlutil.Normalize(link.Url), link.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+* Function: dbMiddleware
+*
+* Parameters: db *sql.DB - A pointer to the database object
+*
+* Returns: echo.MiddlewareFunc - A middleware function that sets the database object in the echo context
+*
+* Description: This function is used to create a middleware function that sets the database object in the context
+*              of requests. This allows handlers to access the database object without having to pass it in as a parameter
+*
+ */
+func dbMiddleware(db *sql.DB) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("db", db)
+			return next(c)
+		}
+	}
+}
+
+/*
+* Interface: dbQuerier
+*
+* Description: The subset of methods shared by *sql.DB and *sql.Tx, this allows the link functions to be used
+*              both on their own and as part of a transaction
+ */
+type dbQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+/*
+* Interface: rowScanner
+*
+* Description: Implemented by both *sql.Row and *sql.Rows so a single function can scan links from either
+ */
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// The columns selected by every query that returns full links, in the order that scanLink expects them
+const linkColumns = "id, shortcode, url, userId, clicks, tags, expires_at, created_at, title, description, last_clicked_at, meta_title, meta_description, meta_favicon, meta_fetched_at, og_title, og_description, og_image, password_hash, sticky_variants, passthrough_mode, utm_source, utm_medium, utm_campaign, prefix_mode, fallback_url, domain"
+
+/*
+* Function: scanLink
+*
+* Parameters: row   rowScanner - The row to scan, it must have been selected using linkColumns
+*             extra ...any       - Destinations for any columns selected after linkColumns
+*
+* Returns: *globalstructs.Link - A pointer to the scanned link
+*          error               - Any error that occurred while scanning the row
+*
+* Description: This function is used to convert a row from the links table into a Link struct
+ */
+func scanLink(row rowScanner, extra ...any) (*globalstructs.Link, error) {
+	var link globalstructs.Link
+	var tags string
+	dest := []any{&link.ID, &link.Shortcode, &link.Url, &link.UserId, &link.Clicks, &tags, &link.ExpiresAt, &link.CreatedAt, &link.Title, &link.Description, &link.LastClickedAt,
+		&link.MetaTitle, &link.MetaDescription, &link.MetaFavicon, &link.MetaFetchedAt,
+		&link.OgTitle, &link.OgDescription, &link.OgImage, &link.PasswordHash, &link.StickyVariants,
+		&link.PassthroughMode, &link.UtmSource, &link.UtmMedium, &link.UtmCampaign, &link.PrefixMode, &link.FallbackUrl, &link.Domain}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	link.Tags = SplitTags(tags)
+
+	return &link, nil
+}
+
+/*
+* Function: ParseTags
+*
+* Parameters: raw string - Tags separated by commas, semicolons or pipes
+*
+* Returns: []string - The lowercased, trimmed and deduplicated tags in the order they were given
+*
+* Description: This function is used to clean up tags entered by a user before they are stored
+ */
+func ParseTags(raw string) []string {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ';' || r == '|'
+	})
+
+	var tags []string
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		tag := strings.ToLower(strings.TrimSpace(field))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+/*
+* Function: SplitTags
+*
+* Parameters: stored string - The tags column of a link
+*
+* Returns: []string - The individual tags, nil if the link has none
+*
+* Description: Tags are stored in a single column joined with commas, this function splits them back apart
+ */
+func SplitTags(stored string) []string {
+	if stored == "" {
+		return nil
+	}
+	return strings.Split(stored, ",")
+}
+
+/*
+* Function: GenUniqueID
+*
+* Parameters: db     dbQuerier        - A pointer to the database object or a transaction
+*             config *conf.Shortcodes - The shortcode configuration containing the universe, length and filters
+*
+* Returns: int    - The unique id that was generated
+*          string - The shortcode for the id
+*          error  - Any error that occurred during the generation of the id
+*
+* Description: This function is used to generate a unique id for a link. It generates a random id and checks if
+*              it already exists in the database or if its shortcode contains confusable characters (when enabled)
+*              or a denylisted substring. If any check fails, it generates another id and checks again. This process
+*              is repeated until an acceptable id is found or a timeout is reached, in which case an error is returned
+*
+ */
+func GenUniqueID(db dbQuerier, config *conf.Shortcodes) (int, string, error) {
+	maxiters := 10000
+	for idx := 0; idx < maxiters; idx++ {
+		// Create a random id and the shortcode that represents it
+		id := codegen.GenRandID(config.Universe, config.ShortcodeLength)
+		shortcode := codegen.BaseTenToUniverse(id, config.Universe)
+
+		// Reject shortcodes that are hard to read or contain a denied word
+		if config.ExcludeConfusables && codegen.HasConfusables(shortcode) {
+			continue
+		}
+		if codegen.ContainsDenied(shortcode, config.Denylist) {
+			continue
+		}
+
+		// Check if that id already exists, or if the shortcode has been taken as a custom alias on any domain
+		_, err := GetLink(db, id)
+		if err == nil {
+			continue
+		}
+		inUse, err := ShortcodeInUse(db, shortcode)
+		if err == nil && !inUse {
+			return id, shortcode, nil
+		}
+	}
+
+	return 0, "", errors.New("genUniqueID timeout reached, no unique id found")
+}
+
+/*
+* Function: GenShortcode
+*
+* Parameters: universe  string - The universe of characters to use when generating the shortcode
+*            maxchars  int    - The maximum number of characters the shortcode can be
+*
+* Returns: string - The shortcode that was generated
+*
+* Description: This function is used to generate a shortcode for a link. It generates a random id and converts it to
+*              the base b representation of that number where b is the length of universe
+*
+ */
+func GenShortcode(universe string, maxchars int) (string, int) {
+	id := codegen.GenRandID(universe, maxchars)
+	return codegen.BaseTenToUniverse(id, universe), id
+}
+
+/*
+* Function: GetLink
+*
+* Parameters:  db dbQuerier - A pointer to the database object or a transaction
+*              id int       - The id of the link to get
+*
+* Returns: *globalstructs.Link - A pointer to the link that was retrieved
+*          error               - Any error that occurred during the retrieval of the link
+*
+* Description: This function is used to get a link from the links table by its id
+ */
+func GetLink(db dbQuerier, id int) (*globalstructs.Link, error) {
+	return scanLink(db.QueryRow("SELECT "+linkColumns+" FROM links WHERE id = ?", id))
+}
+
+/*
+* Function: GetLinkByShortcode
+*
+* Parameters:  db        dbQuerier - A pointer to the database object or a transaction
+*              domain    string    - The domain the shortcode belongs to, empty for the default host
+*              shortcode string    - The shortcode or custom alias of the link to get
+*
+* Returns: *globalstructs.Link - A pointer to the link that was retrieved
+*          error               - Any error that occurred during the retrieval of the link
+*
+* Description: This function is used to get a link from the links table by its shortcode. The same custom alias
+*              can be used on several domains, so only the links of the given domain are searched
+ */
+func GetLinkByShortcode(db dbQuerier, domain string, shortcode string) (*globalstructs.Link, error) {
+	return scanLink(db.QueryRow("SELECT "+linkColumns+" FROM links WHERE domain = ? AND shortcode = ? LIMIT 1", domain, shortcode))
+}
+
+/*
+* Function: ShortcodeInUse
+*
+* Parameters: db        dbQuerier - A pointer to the database object or a transaction
+*             shortcode string    - The shortcode to look for
+*
+* Returns: bool  - true if a link on any domain has the shortcode
+*          error - Any error that occurred during the lookup
+*
+* Description: This function is used to check that a generated shortcode is free on every domain. Generated
+*              shortcodes come from ids, which are unique across domains, so they are kept unique across domains too
+ */
+func ShortcodeInUse(db dbQuerier, shortcode string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM links WHERE shortcode = ?", shortcode).Scan(&count)
+	return count > 0, err
+}
+
+/*
+* Function: GetUserLinkByURL
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             userId int     - The id of the user that owns the link
+*             domain string  - The domain the link is on, empty for the default host
+*             url    string  - The url to look for, it is normalized before the lookup
+*
+* Returns: *globalstructs.Link - A pointer to the user's link for the url
+*          error               - sql.ErrNoRows if the user has not shortened the url on the domain before
+*
+* Description: This function is used to find a link the user already created for the same url on the same domain
+ */
+func GetUserLinkByURL(db *sql.DB, userId int, domain string, url string) (*globalstructs.Link, error) {
+	return scanLink(db.QueryRow("SELECT "+linkColumns+" FROM links WHERE userId = ? AND domain = ? AND normalized_url = ? LIMIT 1", userId, domain, urlutil.Normalize(url)))
+}
+
+/*
+* Function: AddLink
+*
+* Parameters: db        *sql.DB - A pointer to the database object
+*             id        int     - The id of the link to add
+*             shortcode string  - The shortcode of the link to add
+*             url       string  - The url of the link should redirect to
+*             userId    int     - The id of the user that created the link
+*
+* Returns: error - Any error that occurred during the insertion of the link
+*
+* Description: This function is used to add a link to the links table in the database
+*
+ */
+func AddLink(db *sql.DB, id int, shortcode string, url string, userId int) error {
+	return InsertLink(db, &globalstructs.Link{ID: id, Shortcode: shortcode, Url: url, UserId: userId})
+}
+
+/*
+* Function: InsertLink
+*
+* Parameters: db   dbQuerier           - A pointer to the database object or a transaction
+*             link *globalstructs.Link - The link to add, the click count is ignored and the creation time is set
+*
+* Returns: error - Any error that occurred during the insertion of the link
+*
+* Description: This function is used to add a link along with its optional fields to the links table. It is
+*              used by AddLink and by bulk creation, where all links are inserted in a single transaction
+ */
+func InsertLink(db dbQuerier, link *globalstructs.Link) error {
+	link.CreatedAt = time.Now().Unix()
+
+	_, err := db.Exec("INSERT INTO links (id, shortcode, url, userId, normalized_url, tags, expires_at, created_at, title, description, passthrough_mode, utm_source, utm_medium, utm_campaign, domain) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		link.ID, link.Shortcode, link.Url, link.UserId, urlutil.Normalize(link.Url), strings.Join(link.Tags, ","), link.ExpiresAt, link.CreatedAt, link.Title, link.Description,
+		link.PassthroughMode, link.UtmSource, link.UtmMedium, link.UtmCampaign, link.Domain)
+	return err
+}
+
+/*
+* Function: SetLinkMetadata
+*
+* Parameters: db          *sql.DB - A pointer to the database object
+*             linkId      int     - The id of the link
+*             title       string  - The title of the destination page
+*             description string  - The description of the destination page
+*             favicon     string  - The url of the destination page's icon
+*
+* Returns: error - Any error that occurred during the update
+*
+* Description: This function is used to store the metadata fetched from the destination of a link
+ */
+func SetLinkMetadata(db *sql.DB, linkId int, title, description, favicon string) error {
+	_, err := db.Exec("UPDATE links SET meta_title = ?, meta_description = ?, meta_favicon = ?, meta_fetched_at = ? WHERE id = ?",
+		title, description, favicon, time.Now().Unix(), linkId)
+	return err
+}
+
+/*
+* Function: UpdateLinkSocialPreview
+*
+* Parameters: db          *sql.DB - A pointer to the database object
+*             linkId      int     - The id of the link
+*             title       string  - The og:title shown to link preview crawlers
+*             description string  - The og:description shown to link preview crawlers
+*             image       string  - The url of the og:image shown to link preview crawlers
+*
+* Returns: error - Any error that occurred during the update
+*
+* Description: This function is used to save the social preview the owner of a link has configured
+ */
+func UpdateLinkSocialPreview(db *sql.DB, linkId int, title, description, image string) error {
+	_, err := db.Exec("UPDATE links SET og_title = ?, og_description = ?, og_image = ? WHERE id = ?", title, description, image, linkId)
+	return err
+}
+
+/*
+* Function: SetLinkPassword
+*
+* Parameters: db           *sql.DB - A pointer to the database object
+*             linkId       int     - The id of the link
+*             passwordHash string  - The bcrypt hash of the password, empty to remove the password
+*
+* Returns: error - Any error that occurred during the update
+*
+* Description: This function is used to set or remove the password visitors must enter before being redirected
+ */
+func SetLinkPassword(db *sql.DB, linkId int, passwordHash string) error {
+	_, err := db.Exec("UPDATE links SET password_hash = ? WHERE id = ?", passwordHash, linkId)
+	return err
+}
+
+/*
+* Function: SetLinkPassthroughMode
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the link
+*             mode   string  - "merge", "override" or empty to drop the query string of the short link
+*
+* Returns: error - Any error that occurred during the update
+*
+* Description: This function is used to change what happens to the query string a visitor adds to a short link
+ */
+func SetLinkPassthroughMode(db *sql.DB, linkId int, mode string) error {
+	_, err := db.Exec("UPDATE links SET passthrough_mode = ? WHERE id = ?", mode, linkId)
+	return err
+}
+
+/*
+* Function: SetLinkPrefixMode
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the link
+*             prefix bool    - Whether paths after the shortcode are added to the destination
+*
+* Returns: error - Any error that occurred during the update
+*
+* Description: This function is used to turn path forwarding on or off for a link
+ */
+func SetLinkPrefixMode(db *sql.DB, linkId int, prefix bool) error {
+	_, err := db.Exec("UPDATE links SET prefix_mode = ? WHERE id = ?", prefix, linkId)
+	return err
+}
+
+/*
+* Function: SetLinkFallbackUrl
+*
+* Parameters: db          *sql.DB - A pointer to the database object
+*             linkId      int     - The id of the link
+*             fallbackUrl string  - The web page visitors go to if an app link does not open, empty to remove it
+*
+* Returns: error - Any error that occurred during the update
+*
+* Description: This function is used to set the fallback url of a link from its settings page
+ */
+func SetLinkFallbackUrl(db *sql.DB, linkId int, fallbackUrl string) error {
+	_, err := db.Exec("UPDATE links SET fallback_url = ? WHERE id = ?", fallbackUrl, linkId)
+	return err
+}
+
+/*
+* Function: SetLinkClaimToken
+*
+* Parameters: db        *sql.DB - A pointer to the database object
+*             linkId    int     - The id of the link
+*             tokenHash string  - The hash of the claim token, see HashClaimToken
+*
+* Returns: error - Any error that occurred during the update
+*
+* Description: This function is used to store the claim token that lets the anonymous creator of a link move it
+*              into their account
+ */
+func SetLinkClaimToken(db *sql.DB, linkId int, tokenHash string) error {
+	_, err := db.Exec("UPDATE links SET claim_token = ? WHERE id = ?", tokenHash, linkId)
+	return err
+}
+
+/*
+* Function: GetLinkByClaimToken
+*
+* Parameters: db        *sql.DB - A pointer to the database object
+*             tokenHash string  - The hash of the claim token, see HashClaimToken
+*
+* Returns: *globalstructs.Link - The unclaimed anonymous link the token belongs to
+*          error               - sql.ErrNoRows if the token is unknown or has already been used
+*
+* Description: This function is used to find the link a claim token was created for
+ */
+func GetLinkByClaimToken(db *sql.DB, tokenHash string) (*globalstructs.Link, error) {
+	row := db.QueryRow("SELECT "+linkColumns+" FROM links WHERE claim_token = ? AND claim_token != '' AND userId = -1", tokenHash)
+	return scanLink(row)
+}
+
+/*
+* Function: ClaimLink
+*
+* Parameters: db        *sql.DB - A pointer to the database object
+*             tokenHash string  - The hash of the claim token, see HashClaimToken
+*             userId    int     - The id of the user claiming the link
+*
+* Returns: error - sql.ErrNoRows if the token is unknown or was used by another request first
+*
+* Description: This function is used to move an anonymous link into a user's account. The token is cleared in the
+*              same statement so it can only ever be used once
+ */
+func ClaimLink(db *sql.DB, tokenHash string, userId int) error {
+	result, err := db.Exec("UPDATE links SET userId = ?, claim_token = '' WHERE claim_token = ? AND claim_token != '' AND userId = -1", userId, tokenHash)
+	if err != nil {
+		return err
+	}
+
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if claimed == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+/*
+* Function: DeleteLink
+*
+* Parameters: db *sql.DB - A pointer to the database object
+*             id int    - The id of the link to delete
+*
+* Returns: error - Any error that occurred during the deletion of the link
+*
+* Description: This function is used to delete a link from the links table in the database
+*              based on the id of the link, along with its clicks per day, redirect rules and variants
+*
+ */
+func DeleteLink(db *sql.DB, id int) error {
+	_, err := db.Exec("DELETE FROM links WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM daily_clicks WHERE linkId = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM link_rules WHERE linkId = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM link_variants WHERE linkId = ?", id)
+	return err
+}
+
+/*
+* Function: IncrementLinkClickCount
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the link to increment
+*
+* Returns: error - Any error that occurred during the increment of the link click count
+*
+* Description: This function is used to increment the click count of a link in the database, both the total and
+*              the count for the current day, and record the time of the click
+ */
+func IncrementLinkClickCount(db *sql.DB, linkId int) error {
+	statement, err := db.Prepare("UPDATE links SET clicks = clicks + 1, last_clicked_at = ? WHERE id = ? ")
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = statement.Exec(now.Unix(), linkId)
+	if err != nil {
+		return err
+	}
+
+	day := now.UTC().Format("2006-01-02")
+	_, err = db.Exec("INSERT INTO daily_clicks (linkId, day, clicks) VALUES (?, ?, 1) ON CONFLICT (linkId, day) DO UPDATE SET clicks = clicks + 1", linkId, day)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/*
+* Function: GetLinkRules
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the link
+*
+* Returns: []globalstructs.LinkRule - The redirect rules of the link in the order they are checked
+*          error                    - Any error that occurred during the query
+*
+* Description: This function is used to get the rules of a link when redirecting and on its settings page
+ */
+func GetLinkRules(db *sql.DB, linkId int) ([]globalstructs.LinkRule, error) {
+	rows, err := db.Query("SELECT id, linkId, position, kind, value, url, clicks FROM link_rules WHERE linkId = ? ORDER BY position, id", linkId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []globalstructs.LinkRule
+	for rows.Next() {
+		var rule globalstructs.LinkRule
+		err = rows.Scan(&rule.ID, &rule.LinkId, &rule.Position, &rule.Kind, &rule.Value, &rule.Url, &rule.Clicks)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+/*
+* Function: InsertLinkRule
+*
+* Parameters: db   *sql.DB                 - A pointer to the database object
+*             rule *globalstructs.LinkRule - The rule to add, its ID and Position are set
+*
+* Returns: error - Any error that occurred during the insert
+*
+* Description: This function is used to add a rule after the existing rules of a link
+ */
+func InsertLinkRule(db *sql.DB, rule *globalstructs.LinkRule) error {
+	result, err := db.Exec("INSERT INTO link_rules (linkId, position, kind, value, url) SELECT ?, COALESCE(MAX(position), 0) + 1, ?, ?, ? FROM link_rules WHERE linkId = ?",
+		rule.LinkId, rule.Kind, rule.Value, rule.Url, rule.LinkId)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	rule.ID = int(id)
+
+	return db.QueryRow("SELECT position FROM link_rules WHERE id = ?", rule.ID).Scan(&rule.Position)
+}
+
+/*
+* Function: DeleteLinkRule
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the link the rule belongs to
+*             ruleId int     - The id of the rule
+*
+* Returns: error - sql.ErrNoRows if the link has no such rule
+*
+* Description: This function is used to remove a rule from a link
+ */
+func DeleteLinkRule(db *sql.DB, linkId int, ruleId int) error {
+	result, err := db.Exec("DELETE FROM link_rules WHERE id = ? AND linkId = ?", ruleId, linkId)
+	if err != nil {
+		return err
+	}
+	return sessmngt.RequireRowsAffected(result)
+}
+
+/*
+* Function: MoveLinkRuleUp
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the link the rule belongs to
+*             ruleId int     - The id of the rule
+*
+* Returns: error - sql.ErrNoRows if the link has no such rule
+*
+* Description: This function is used to swap a rule with the one checked before it, the first rule stays where
+*              it is
+ */
+func MoveLinkRuleUp(db *sql.DB, linkId int, ruleId int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var position int
+	err = tx.QueryRow("SELECT position FROM link_rules WHERE id = ? AND linkId = ?", ruleId, linkId).Scan(&position)
+	if err != nil {
+		return err
+	}
+
+	var previousId, previousPosition int
+	err = tx.QueryRow("SELECT id, position FROM link_rules WHERE linkId = ? AND position < ? ORDER BY position DESC LIMIT 1", linkId, position).Scan(&previousId, &previousPosition)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE link_rules SET position = ? WHERE id = ?", previousPosition, ruleId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE link_rules SET position = ? WHERE id = ?", position, previousId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+* Function: IncrementLinkRuleClickCount
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             ruleId int     - The id of the rule that sent a visitor on
+*
+* Returns: error - Any error that occurred during the update
+*
+* Description: This function is used to attribute a click to the rule that matched it. The click is counted for
+*              the link as well by IncrementLinkClickCount
+ */
+func IncrementLinkRuleClickCount(db *sql.DB, ruleId int) error {
+	_, err := db.Exec("UPDATE link_rules SET clicks = clicks + 1 WHERE id = ?", ruleId)
+	return err
+}
+
+/*
+* Function: GetLinkVariants
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the link
+*
+* Returns: []globalstructs.LinkVariant - The variants of the link in the order they were added
+*          error                       - Any error that occurred during the query
+*
+* Description: This function is used to get the destinations a link splits its traffic between
+ */
+func GetLinkVariants(db *sql.DB, linkId int) ([]globalstructs.LinkVariant, error) {
+	variants, err := GetVariantsForLinks(db, []int{linkId})
+	if err != nil {
+		return nil, err
+	}
+	return variants[linkId], nil
+}
+
+/*
+* Function: GetVariantsForLinks
+*
+* Parameters: db      *sql.DB - A pointer to the database object
+*             linkIds []int   - The ids of the links
+*
+* Returns: map[int][]globalstructs.LinkVariant - The variants of each link that has any, by link id
+*          error                               - Any error that occurred during the query
+*
+* Description: This function is used to load the variants of a page of links with one query. Variants are
+*              labelled A, B, C and so on in the order they were added
+ */
+func GetVariantsForLinks(db *sql.DB, linkIds []int) (map[int][]globalstructs.LinkVariant, error) {
+	variants := make(map[int][]globalstructs.LinkVariant)
+	if len(linkIds) == 0 {
+		return variants, nil
+	}
+
+	placeholders := make([]string, len(linkIds))
+	args := make([]any, len(linkIds))
+	for i, id := range linkIds {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := db.Query("SELECT id, linkId, url, weight, clicks FROM link_variants WHERE linkId IN ("+strings.Join(placeholders, ", ")+") ORDER BY linkId, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var variant globalstructs.LinkVariant
+		err = rows.Scan(&variant.ID, &variant.LinkId, &variant.Url, &variant.Weight, &variant.Clicks)
+		if err != nil {
+			return nil, err
+		}
+		variant.Label = variantLabel(len(variants[variant.LinkId]))
+		variants[variant.LinkId] = append(variants[variant.LinkId], variant)
+	}
+
+	return variants, rows.Err()
+}
+
+/*
+* Function: variantLabel
+*
+* Parameters: index int - The position of the variant among the variants of its link, starting at 0
+*
+* Returns: string - A, B, ... Z, then AA, AB and so on
+*
+* Description: Names a variant the way A/B tests usually do
+ */
+func variantLabel(index int) string {
+	label := ""
+	for index >= 0 {
+		label = string(rune('A'+index%26)) + label
+		index = index/26 - 1
+	}
+	return label
+}
+
+/*
+* Function: InsertLinkVariant
+*
+* Parameters: db      *sql.DB                    - A pointer to the database object
+*             variant *globalstructs.LinkVariant - The variant to add, its ID is set
+*
+* Returns: error - Any error that occurred during the insert
+*
+* Description: This function is used to add a destination to a link
+ */
+func InsertLinkVariant(db *sql.DB, variant *globalstructs.LinkVariant) error {
+	result, err := db.Exec("INSERT INTO link_variants (linkId, url, weight) VALUES (?, ?, ?)", variant.LinkId, variant.Url, variant.Weight)
 	if err != nil {
-		e.Logger.Fatalf("DB setup failed on table sessions. Error: %s", err.Error())
+		return err
 	}
-	_, err = statement.Exec()
+
+	id, err := result.LastInsertId()
 	if err != nil {
-		e.Logger.Fatalf("DB setup failed on table sessions. Error: %s", err.Error())
+		return err
 	}
+	variant.ID = int(id)
+
+	return nil
 }
 
 /*
-* Function: dbMiddleware
+* Function: SetLinkVariantWeight
 *
-* Parameters: db *sql.DB - A pointer to the database object
-*
-* Returns: echo.MiddlewareFunc - A middleware function that sets the database object in the echo context
+* Parameters: db        *sql.DB - A pointer to the database object
+*             linkId    int     - The id of the link the variant belongs to
+*             variantId int     - The id of the variant
+*             weight    int     - The new weight of the variant
 *
-* Description: This function is used to create a middleware function that sets the database object in the context
-*              of requests. This allows handlers to access the database object without having to pass it in as a parameter
+* Returns: error - sql.ErrNoRows if the link has no such variant
 *
+* Description: This function is used to change the share of traffic a variant gets
  */
-func dbMiddleware(db *sql.DB) echo.MiddlewareFunc {
-	return func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			c.Set("db", db)
-			return next(c)
-		}
+func SetLinkVariantWeight(db *sql.DB, linkId int, variantId int, weight int) error {
+	result, err := db.Exec("UPDATE link_variants SET weight = ? WHERE id = ? AND linkId = ?", weight, variantId, linkId)
+	if err != nil {
+		return err
 	}
+	return sessmngt.RequireRowsAffected(result)
 }
 
 /*
-* Function: GenUniqueID
-*
-* Parameters: db       *sql.DB - A pointer to the database object
-*            universe  string  - The universe of characters to use when generating the id
-*            maxchars  int     - The maximum number of characters the id can be
+* Function: DeleteLinkVariant
 *
-* Returns: int   - The unique id that was generated
-*          error - Any error that occurred during the generation of the id
+* Parameters: db        *sql.DB - A pointer to the database object
+*             linkId    int     - The id of the link the variant belongs to
+*             variantId int     - The id of the variant
 *
-* Description: This function is used to generate a unique id for a link. It generates a random id and checks if
-*           it already exists in the database. If it does, it generates another id and checks again. This process
-*          is repeated until a unique id is found or a timeout is reached, in which case an error is returned
+* Returns: error - sql.ErrNoRows if the link has no such variant
 *
+* Description: This function is used to remove a destination from a link
  */
-func GenUniqueID(db *sql.DB, universe string, maxchars int) (int, error) {
-	maxiters := 10000
-	idx := 0
-	for {
-		if idx > maxiters {
-			return 0, errors.New("genUniqueID timeout reached, no unique id found")
-		}
-		// Create a random id
-		id := codegen.GenRandID(universe, maxchars)
-		// Check if that id already exists
-		_, err := GetLink(db, id)
-		// If no link with this id is found, err will not be nil, meaning this id is safe
-		if err != nil {
-			return id, nil
-		}
+func DeleteLinkVariant(db *sql.DB, linkId int, variantId int) error {
+	result, err := db.Exec("DELETE FROM link_variants WHERE id = ? AND linkId = ?", variantId, linkId)
+	if err != nil {
+		return err
 	}
+	return sessmngt.RequireRowsAffected(result)
 }
 
 /*
-* Function: GenShortcode
-*
-* Parameters: universe  string - The universe of characters to use when generating the shortcode
-*            maxchars  int    - The maximum number of characters the shortcode can be
+* Function: IncrementLinkVariantClickCount
 *
-* Returns: string - The shortcode that was generated
+* Parameters: db        *sql.DB - A pointer to the database object
+*             variantId int     - The id of the variant a visitor was sent to
 *
-* Description: This function is used to generate a shortcode for a link. It generates a random id and converts it to
-*              the base b representation of that number where b is the length of universe
+* Returns: error - Any error that occurred during the update
 *
+* Description: This function is used to attribute a click to a variant. The click is counted for the link as well
+*              by IncrementLinkClickCount
  */
-func GenShortcode(universe string, maxchars int) (string, int) {
-	id := codegen.GenRandID(universe, maxchars)
-	return codegen.BaseTenToUniverse(id, universe), id
+func IncrementLinkVariantClickCount(db *sql.DB, variantId int) error {
+	_, err := db.Exec("UPDATE link_variants SET clicks = clicks + 1 WHERE id = ?", variantId)
+	return err
 }
 
 /*
-* Function: GetLink
+* Function: SetLinkStickyVariants
 *
-* Parameters:  db *sql.DB - A pointer to the database object
-*              id int     - The id of the link to get
+* Parameters: db     *sql.DB - A pointer to the database object
+*             linkId int     - The id of the link
+*             sticky bool    - Whether returning visitors keep the variant they were first given
 *
-* Returns: *globalstructs.Link - A pointer to the link that was retrieved
-*          error               - Any error that occurred during the retrieval of the link
+* Returns: error - Any error that occurred during the update
 *
-* Description:
+* Description: This function is used to turn sticky variants on or off for a link
  */
-func GetLink(db *sql.DB, id int) (*globalstructs.Link, error) {
-	var link globalstructs.Link
-	err := db.QueryRow("SELECT id, url, userId, clicks FROM links WHERE id = ?", id).Scan(&link.ID, &link.Url, &link.UserId, &link.Clicks)
-	if err != nil {
-		return nil, err
-	}
-	return &link, nil
+func SetLinkStickyVariants(db *sql.DB, linkId int, sticky bool) error {
+	_, err := db.Exec("UPDATE links SET sticky_variants = ? WHERE id = ?", sticky, linkId)
+	return err
 }
 
+// Matches links that have not been created or clicked since a cutoff time. Links created before creation times
+// were recorded that have never been clicked have no known age and are never matched
+const unusedLinkCondition = "MAX(created_at, last_clicked_at) != 0 AND MAX(created_at, last_clicked_at) < ?"
+
 /*
-* Function: AddLink
-*
-* Parameters: db        *sql.DB - A pointer to the database object
-*             id        int     - The id of the link to add
-*             shortcode string  - The shortcode of the link to add
-*             url       string  - The url of the link should redirect to
-*             userId    int     - The id of the user that created the link
+* Function: GetUnusedLinks
 *
-* Returns: error - Any error that occurred during the insertion of the link
+* Parameters: db     *sql.DB - A pointer to the database object
+*             cutoff int64   - A unix time, links not created or clicked since then are returned
 *
-* Description: This function is used to add a link to the links table in the database
+* Returns: []globalstructs.Link - The links that have not been used since the cutoff
+*          error                - Any error that occurred during the retrieval
 *
+* Description: This function is used to find links that a cleanup policy would delete
  */
-func AddLink(db *sql.DB, id int, shortcode string, url string, userId int) error {
-	insert, err := db.Prepare("INSERT INTO links (id, shortcode, url, userId) VALUES (?, ?, ?, ?)")
+func GetUnusedLinks(db *sql.DB, cutoff int64) ([]globalstructs.Link, error) {
+	rows, err := db.Query("SELECT "+linkColumns+" FROM links WHERE "+unusedLinkCondition, cutoff)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	_, err = insert.Exec(id, shortcode, url, userId)
-	if err != nil {
-		log.Fatal(err.Error())
-		return err
+	var links []globalstructs.Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, *link)
 	}
 
-	return nil
+	return links, rows.Err()
 }
 
 /*
-* Function: DeleteLink
+* Function: DeleteUnusedLinks
 *
-* Parameters: db *sql.DB - A pointer to the database object
-*             id int    - The id of the link to delete
+* Parameters: db     *sql.DB - A pointer to the database object
+*             cutoff int64   - A unix time, links not created or clicked since then are deleted
 *
-* Returns: error - Any error that occurred during the deletion of the link
+* Returns: int64 - The number of links deleted
+*          error - Any error that occurred during the deletion
 *
-* Description: This function is used to delete a link from the links table in the database
-*              based on the id of the link
+* Description: This function is used to delete links that have not been used since the cutoff, along with their
+*              clicks per day
+ */
+func DeleteUnusedLinks(db *sql.DB, cutoff int64) (int64, error) {
+	return deleteLinksWhere(db, unusedLinkCondition, cutoff)
+}
+
+/*
+* Function: DeleteOldAnonymousLinks
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             cutoff int64   - A unix time, anonymous links created before then are deleted
 *
+* Returns: int64 - The number of links deleted
+*          error - Any error that occurred during the deletion
+*
+* Description: This function is used to delete links created by users that were not logged in once they reach the
+*              maximum age, however often they are clicked
  */
-func DeleteLink(db *sql.DB, id int) error {
-	_, err := db.Exec("DELETE FROM links WHERE id = ?", id)
-	return err
+func DeleteOldAnonymousLinks(db *sql.DB, cutoff int64) (int64, error) {
+	return deleteLinksWhere(db, "userId = -1 AND created_at != 0 AND created_at < ?", cutoff)
 }
 
 /*
-* Function: IncrementLinkClickCount
+* Function: DeleteUnusedAnonymousLinks
 *
 * Parameters: db     *sql.DB - A pointer to the database object
-*             linkId int     - The id of the link to increment
+*             cutoff int64   - A unix time, anonymous links not created or clicked since then are deleted
 *
-* Returns: error - Any error that occurred during the increment of the link click count
+* Returns: int64 - The number of links deleted
+*          error - Any error that occurred during the deletion
 *
-* Description: This function is used to increment the click count of a link in the database
+* Description: This function is used to delete links created by users that were not logged in once they have not
+*              been used since the cutoff
  */
-func IncrementLinkClickCount(db *sql.DB, linkId int) error {
-	statement, err := db.Prepare("UPDATE links SET clicks = clicks + 1 WHERE id = ? ")
+func DeleteUnusedAnonymousLinks(db *sql.DB, cutoff int64) (int64, error) {
+	return deleteLinksWhere(db, "userId = -1 AND "+unusedLinkCondition, cutoff)
+}
+
+/*
+* Function: deleteLinksWhere
+*
+* Parameters: db        *sql.DB - A pointer to the database object
+*             condition string  - The WHERE clause selecting the links to delete
+*             args      ...any  - The values for the placeholders in the condition
+*
+* Returns: int64 - The number of links deleted
+*          error - Any error that occurred during the deletion
+*
+* Description: Deletes the links matching a condition, then the clicks per day, redirect rules and variants of
+*              any link that no longer exists
+ */
+func deleteLinksWhere(db *sql.DB, condition string, args ...any) (int64, error) {
+	result, err := db.Exec("DELETE FROM links WHERE "+condition, args...)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = statement.Exec(linkId)
+	deleted, err := result.RowsAffected()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	_, err = db.Exec("DELETE FROM daily_clicks WHERE linkId NOT IN (SELECT id FROM links)")
+	if err != nil {
+		return deleted, err
+	}
+
+	_, err = db.Exec("DELETE FROM link_rules WHERE linkId NOT IN (SELECT id FROM links)")
+	if err != nil {
+		return deleted, err
+	}
+
+	_, err = db.Exec("DELETE FROM link_variants WHERE linkId NOT IN (SELECT id FROM links)")
+	return deleted, err
 }
 
 /*
@@ -258,24 +1233,302 @@ func GetLinkClicks(db *sql.DB, linkId int) (int, error) {
 func GetUserLinks(db *sql.DB, userId int) ([]globalstructs.Link, error) {
 	var links []globalstructs.Link
 
-	rows, err := db.Query("SELECT id, shortcode, url, clicks FROM links WHERE userId = ?", userId)
+	rows, err := db.Query("SELECT "+linkColumns+" FROM links WHERE userId = ?", userId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var link globalstructs.Link
-		err = rows.Scan(&link.ID, &link.Shortcode, &link.Url, &link.Clicks)
+		link, err := scanLink(rows)
 		if err != nil {
 			return nil, err
 		}
-		links = append(links, link)
+		links = append(links, *link)
 	}
 
 	return links, nil
 }
 
+/*
+* Struct: linkSort
+*
+* Description: Describes an order the user page can be sorted in. The id of each link is used to break ties so
+*              that every link has a unique position, which keyset pagination relies on
+ */
+type linkSort struct {
+	Column     string                           // The column the links are ordered by
+	Descending bool                             // true to show the largest values first
+	Numeric    bool                             // true if the column holds integers
+	Value      func(*globalstructs.Link) string // Returns the value of the column for a link, used to build cursors
+}
+
+// The orders the user page can be sorted in, keyed by the value of the sort query parameter
+var linkSorts = map[string]linkSort{
+	"created": {Column: "created_at", Descending: true, Numeric: true, Value: func(link *globalstructs.Link) string {
+		return strconv.FormatInt(link.CreatedAt, 10)
+	}},
+	"clicks": {Column: "clicks", Descending: true, Numeric: true, Value: func(link *globalstructs.Link) string {
+		return strconv.Itoa(link.Clicks)
+	}},
+	"shortcode": {Column: "shortcode", Descending: false, Numeric: false, Value: func(link *globalstructs.Link) string {
+		return link.Shortcode
+	}},
+}
+
+// Returned by SearchUserLinks when the cursor of the query was not created by SearchUserLinks
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+/*
+* Function: SearchUserLinks
+*
+* Parameters: db     *sql.DB                 - A pointer to the database object
+*             userId int                     - The id of the user whose links to search
+*             query  globalstructs.LinkQuery - The search text, tag, sort order, cursor and page size
+*
+* Returns: []globalstructs.Link - The links on the requested page
+*          int                  - The total number of links that match the search and tag, only counted for the
+*                                 first page (when query.After is empty) and 0 otherwise
+*          string               - The cursor for the next page, empty if this is the last page
+*          error                - Any error that occurred during the retrieval, ErrInvalidCursor for a bad cursor
+*
+* Description: This function is used to get one page of a user's links. The search text is matched against the
+*              url, shortcode, title, description and tags of each link. Pages are found using the sort value and
+*              id of the last link on the previous page rather than an offset, so every page is equally fast to
+*              load no matter how many links the user has
+ */
+func SearchUserLinks(db *sql.DB, userId int, query globalstructs.LinkQuery) ([]globalstructs.Link, int, string, error) {
+	where := "userId = ?"
+	args := []any{userId}
+
+	if query.Search != "" {
+		pattern := "%" + escapeLike(query.Search) + "%"
+		where += " AND (url LIKE ? ESCAPE '\\' OR shortcode LIKE ? ESCAPE '\\' OR title LIKE ? ESCAPE '\\' OR description LIKE ? ESCAPE '\\' OR tags LIKE ? ESCAPE '\\' OR meta_title LIKE ? ESCAPE '\\')"
+		args = append(args, pattern, pattern, pattern, pattern, pattern, pattern)
+	}
+
+	// Tags are stored comma separated, surrounding them with commas lets a whole tag be matched
+	if query.Tag != "" {
+		where += " AND (',' || tags || ',') LIKE ? ESCAPE '\\'"
+		args = append(args, "%,"+escapeLike(query.Tag)+",%")
+	}
+
+	total := 0
+	if query.After == "" {
+		err := db.QueryRow("SELECT COUNT(*) FROM links WHERE "+where, args...).Scan(&total)
+		if err != nil {
+			return nil, 0, "", err
+		}
+	}
+
+	order, ok := linkSorts[query.Sort]
+	if !ok {
+		order = linkSorts["created"]
+	}
+	direction, comparison := "ASC", ">"
+	if order.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	// Continue after the last link of the previous page
+	if query.After != "" {
+		value, id, err := decodeCursor(query.After, order.Numeric)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		where += " AND (" + order.Column + ", id) " + comparison + " (?, ?)"
+		args = append(args, value, id)
+	}
+
+	// One extra link is read to find out if there is another page
+	rows, err := db.Query("SELECT "+linkColumns+" FROM links WHERE "+where+" ORDER BY "+order.Column+" "+direction+", id "+direction+" LIMIT ?",
+		append(args, query.PerPage+1)...)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer rows.Close()
+
+	var links []globalstructs.Link
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		links = append(links, *link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, "", err
+	}
+
+	next := ""
+	if len(links) > query.PerPage {
+		links = links[:query.PerPage]
+		last := &links[len(links)-1]
+		next = encodeCursor(order.Value(last), last.ID)
+	}
+
+	return links, total, next, nil
+}
+
+/*
+* Function: encodeCursor
+*
+* Parameters: value string - The sort value of the last link on a page
+*             id    int    - The id of the last link on a page
+*
+* Returns: string - A cursor that can be safely placed in a url
+*
+* Description: Encodes the position of a link in a sorted list of links
+ */
+func encodeCursor(value string, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + strconv.Itoa(id)
+}
+
+/*
+* Function: decodeCursor
+*
+* Parameters: cursor  string - A cursor created by encodeCursor
+*             numeric bool   - true if the sort value is an integer
+*
+* Returns: any   - The sort value, an int64 if numeric is true and a string otherwise
+*          int   - The id of the link
+*          error - ErrInvalidCursor if the cursor could not be decoded
+*
+* Description: Decodes the position of a link in a sorted list of links
+ */
+func decodeCursor(cursor string, numeric bool) (any, int, error) {
+	encodedValue, encodedId, found := strings.Cut(cursor, ".")
+	if !found {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	rawValue, err := base64.RawURLEncoding.DecodeString(encodedValue)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	id, err := strconv.Atoi(encodedId)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	if !numeric {
+		return string(rawValue), id, nil
+	}
+
+	value, err := strconv.ParseInt(string(rawValue), 10, 64)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	return value, id, nil
+}
+
+/*
+* Function: escapeLike
+*
+* Parameters: text string - Text entered by a user
+*
+* Returns: string - The text with the LIKE wildcards % and _ escaped with a backslash
+*
+* Description: Allows user input to be used in a LIKE pattern without its characters acting as wildcards
+ */
+func escapeLike(text string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(text)
+}
+
+/*
+* Function: GetUserTags
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             userId int     - The id of the user
+*
+* Returns: []string - Every tag used on the user's links, sorted alphabetically
+*          error    - Any error that occurred during the retrieval
+*
+* Description: This function is used to get the tags a user can filter their links by
+ */
+func GetUserTags(db *sql.DB, userId int) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT tags FROM links WHERE userId = ? AND tags != ''", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[string]bool)
+	var tags []string
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			return nil, err
+		}
+		for _, tag := range SplitTags(stored) {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+
+	return tags, rows.Err()
+}
+
+/*
+* Function: StreamUserLinks
+*
+* Parameters: db     *sql.DB - A pointer to the database object
+*             userId int     - The id of the user whose links to read
+*             fn     func    - Called once for each link with the link and its clicks per day, oldest day first
+*
+* Returns: error - Any error that occurred reading the links, or the first error returned by fn
+*
+* Description: This function is used to read every link a user owns along with its clicks per day, one link at a
+*              time, so that large accounts can be processed without holding all of their links in memory
+ */
+func StreamUserLinks(db *sql.DB, userId int, fn func(*globalstructs.Link, []globalstructs.DailyClicks) error) error {
+	// The daily counts are joined on so that each link's days arrive directly after each other
+	rows, err := db.Query("SELECT l.*, d.day, d.clicks FROM (SELECT "+linkColumns+" FROM links WHERE userId = ?) AS l "+
+		"LEFT JOIN daily_clicks AS d ON d.linkId = l.id ORDER BY l.id, d.day", userId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var current *globalstructs.Link
+	var daily []globalstructs.DailyClicks
+	for rows.Next() {
+		var day sql.NullString
+		var dayClicks sql.NullInt64
+		link, err := scanLink(rows, &day, &dayClicks)
+		if err != nil {
+			return err
+		}
+
+		// Hand off the previous link once all of its days have been read
+		if current != nil && current.ID != link.ID {
+			if err := fn(current, daily); err != nil {
+				return err
+			}
+			daily = nil
+		}
+		current = link
+
+		if day.Valid {
+			daily = append(daily, globalstructs.DailyClicks{Day: day.String, Clicks: int(dayClicks.Int64)})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if current != nil {
+		return fn(current, daily)
+	}
+
+	return nil
+}
+
 /*
 * Function: GetAllUsers
 *
@@ -287,7 +1540,7 @@ func GetUserLinks(db *sql.DB, userId int) ([]globalstructs.Link, error) {
 *           and return them as a slice. Used mostly for debugging
  */
 func GetAllUsers(db *sql.DB) []sessmngt.UserLogin {
-	rows, err := db.Query("SELECT email, username, password, permissions FROM users")
+	rows, err := db.Query("SELECT id, email, username, password, permissions FROM users")
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -295,7 +1548,7 @@ func GetAllUsers(db *sql.DB) []sessmngt.UserLogin {
 	var users []sessmngt.UserLogin
 	for rows.Next() {
 		var user sessmngt.UserLogin
-		if err := rows.Scan(&user.Email, &user.Username, &user.Password, &user.Permissions); err != nil {
+		if err := rows.Scan(&user.Id, &user.Email, &user.Username, &user.Password, &user.Permissions); err != nil {
 			log.Fatal(err.Error())
 		}
 
@@ -315,19 +1568,19 @@ func GetAllUsers(db *sql.DB) []sessmngt.UserLogin {
 * Description: This function is used to get all the links in the links table in the database
  */
 func GetAllLinks(db *sql.DB) []globalstructs.Link {
-	rows, err := db.Query("SELECT id, shortcode, url, userId, clicks FROM links")
+	rows, err := db.Query("SELECT " + linkColumns + " FROM links")
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	var links []globalstructs.Link
 	for rows.Next() {
-		var link globalstructs.Link
-		if err := rows.Scan(&link.ID, &link.Shortcode, &link.Url, &link.UserId, &link.Clicks); err != nil {
+		link, err := scanLink(rows)
+		if err != nil {
 			log.Fatal(err.Error())
 		}
 
-		links = append(links, link)
+		links = append(links, *link)
 	}
 
 	return links
@@ -0,0 +1,162 @@
+/*
+* File: cmd/deeplink.go
+*
+* Description: This file contains the handling of links to apps, such as myapp://product/1. Browsers refuse to
+*              follow most redirects to custom schemes, so visitors are shown a page that tries to open the app and
+*              goes to the link's fallback url if it does not open
+*
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+	"github.com/vtallen/go-link-shortener/internal/sessmngt"
+	"github.com/vtallen/go-link-shortener/pkg/urlutil"
+)
+
+// How long the deep link page waits for the app when deeplinks.fallback_delay_ms is not set
+const defaultFallbackDelayMs = 1500
+
+/*
+* Function: isWebScheme
+*
+* Parameters: scheme string - The lowercased scheme of a url
+*
+* Returns: bool - true for http and https, which are redirected to directly
+*
+* Description: Tells web destinations apart from app links
+ */
+func isWebScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
+
+/*
+* Function: validateDestination
+*
+* Parameters: config *conf.Config - The configuration for the application
+*             rawURL string       - A destination given for a link, rule or variant
+*
+* Returns: error - A message describing why the destination cannot be used, nil if it can
+*
+* Description: Web destinations must have a host. Other schemes must be listed in deeplinks.allowed_schemes, so
+*              links cannot be made to javascript: or data: urls. Template placeholders are checked as well
+ */
+func validateDestination(config *conf.Config, rawURL string) error {
+	err := urlutil.ValidateTemplate(rawURL)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme == "" {
+		return errors.New("the destination must be a full url")
+	}
+
+	scheme := strings.ToLower(parsed.Scheme)
+	if isWebScheme(scheme) {
+		if parsed.Host == "" {
+			return errors.New("the destination must be a full url")
+		}
+		return nil
+	}
+
+	allowed := slices.ContainsFunc(config.DeepLinks.AllowedSchemes, func(s string) bool {
+		return strings.EqualFold(s, scheme)
+	})
+	if !allowed {
+		return errors.New("links to " + scheme + ": urls are not allowed")
+	}
+
+	return nil
+}
+
+/*
+* Function: renderDeepLink
+*
+* Parameters: c           echo.Context        - The context of the request
+*             config      *conf.Config        - The configuration for the application
+*             link        *globalstructs.Link - The link being followed
+*             destination string              - The app link picked for the visitor
+*
+* Returns: error - If there is an error rendering the page
+*
+* Description: Renders the page that opens an app link. The destination must already have been checked with
+*              validateDestination
+ */
+func renderDeepLink(c echo.Context, config *conf.Config, link *globalstructs.Link, destination string) error {
+	delay := defaultFallbackDelayMs
+	if config.DeepLinks.FallbackDelayMs > 0 {
+		delay = config.DeepLinks.FallbackDelayMs
+	}
+
+	data := globalstructs.DeepLinkData{
+		// html/template would replace a custom scheme url with #ZgotmplZ, the scheme was checked by the caller
+		DeepLink:        template.URL(destination),
+		FallbackURL:     link.FallbackUrl,
+		FallbackDelayMs: delay,
+		ShortURL:        ShortURL(config, link.Domain, link.Shortcode),
+		IsLoggedIn:      sessmngt.ValidateSession(c) == nil,
+	}
+
+	return c.Render(http.StatusOK, "deep-link", data)
+}
+
+/*
+* Function: HandleLinkFallback
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error saving the fallback url or rendering the form
+*
+* Description: Handles a POST request to /user/link/:id/fallback from the settings page, setting the web page
+*              visitors go to when an app link does not open. An empty url removes it
+*
+ */
+func HandleLinkFallback(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data := globalstructs.LinkSettingsData{Link: *link, ShortURL: ShortURL(config, link.Domain, link.Shortcode), IsLoggedIn: true}
+
+	fallback := strings.TrimSpace(c.FormValue("fallback-url"))
+	data.Link.FallbackUrl = fallback
+	if fallback != "" {
+		parsed, err := url.Parse(fallback)
+		if err != nil || !isWebScheme(strings.ToLower(parsed.Scheme)) || parsed.Host == "" {
+			data.HasError = true
+			data.ErrorText = "The fallback must be an http or https url"
+			return c.Render(http.StatusOK, "link-fallback-form", data)
+		}
+	}
+
+	err = SetLinkFallbackUrl(db, link.ID, fallback)
+	if err != nil {
+		c.Logger().Errorf("Could not save the fallback url of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data.Saved = true
+	return c.Render(http.StatusOK, "link-fallback-form", data)
+}
@@ -0,0 +1,239 @@
+/*
+* File: cmd/export.go
+*
+* Description: This file contains the handler that lets a user download all of their links and click statistics
+*              as CSV or JSON. Links are written to the response as they are read from the database
+*
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+)
+
+// The response is flushed to the client every time this many links have been written
+const exportFlushInterval = 100
+
+/*
+* Struct: exportLink
+*
+* Description: The form a link takes in a JSON export
+ */
+type exportLink struct {
+	Shortcode     string                      `json:"shortcode"`
+	ShortURL      string                      `json:"short_url"`
+	URL           string                      `json:"url"`
+	CreatedAt     string                      `json:"created_at"`
+	LastClickedAt string                      `json:"last_clicked_at"`
+	Clicks        int                         `json:"clicks"`
+	Tags          []string                    `json:"tags"`
+	ExpiresAt     string                      `json:"expires_at"`
+	DailyClicks   []globalstructs.DailyClicks `json:"daily_clicks"`
+}
+
+/*
+* Function: HandleExport
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error reading the links or writing the response
+*
+* Description: Handles a GET request to /user/export. The "format" query parameter selects "csv" (the default) or
+*              "json". The export is sent as a download and contains every link the user owns with its clicks per day
+*
+ */
+func HandleExport(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	sess, err := session.Get("session", c)
+	if err != nil {
+		c.Logger().Errorf("Could not get session from context: %s\n", err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	userId, ok := sess.Values["userId"].(int)
+	if !ok {
+		c.Logger().Errorf("Could not convert the session userId to int.\n")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		return c.String(http.StatusBadRequest, "Unknown export format, use csv or json")
+	}
+
+	filename := "links-" + time.Now().Format("20060102-150405") + "." + format
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+
+	if format == "json" {
+		err = writeJSONExport(c, db, config, userId)
+	} else {
+		err = writeCSVExport(c, db, config, userId)
+	}
+
+	// Once streaming has started the status can no longer be changed, so the error is only logged
+	if err != nil {
+		c.Logger().Errorf("Could not export links for user id %d: %s", userId, err.Error())
+	}
+
+	return nil
+}
+
+/*
+* Function: writeCSVExport
+*
+* Parameters: c      echo.Context - The context of the request
+*             db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*             userId int          - The id of the user whose links are exported
+*
+* Returns: error - Any error that occurred while reading or writing the links
+*
+* Description: Writes the user's links as CSV. Clicks per day are written to a single column as "day:clicks" pairs
+*              separated by semicolons
+ */
+func writeCSVExport(c echo.Context, db *sql.DB, config *conf.Config, userId int) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(c.Response())
+	writer.Write([]string{"shortcode", "short_url", "url", "created_at", "last_clicked_at", "clicks", "tags", "expires_at", "daily_clicks"})
+
+	written := 0
+	err := StreamUserLinks(db, userId, func(link *globalstructs.Link, daily []globalstructs.DailyClicks) error {
+		days := make([]string, 0, len(daily))
+		for _, day := range daily {
+			days = append(days, day.Day+":"+strconv.Itoa(day.Clicks))
+		}
+
+		writer.Write([]string{
+			link.Shortcode,
+			ShortURL(config, link.Domain, link.Shortcode),
+			link.Url,
+			formatExportTime(link.CreatedAt),
+			formatExportTime(link.LastClickedAt),
+			strconv.Itoa(link.Clicks),
+			strings.Join(link.Tags, ","),
+			formatExportTime(link.ExpiresAt),
+			strings.Join(days, ";"),
+		})
+
+		written++
+		if written%exportFlushInterval == 0 {
+			writer.Flush()
+			c.Response().Flush()
+		}
+
+		return writer.Error()
+	})
+	if err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+/*
+* Function: writeJSONExport
+*
+* Parameters: c      echo.Context - The context of the request
+*             db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*             userId int          - The id of the user whose links are exported
+*
+* Returns: error - Any error that occurred while reading or writing the links
+*
+* Description: Writes the user's links as a JSON array, encoding one link at a time
+ */
+func writeJSONExport(c echo.Context, db *sql.DB, config *conf.Config, userId int) error {
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	c.Response().WriteHeader(http.StatusOK)
+
+	_, err := c.Response().Write([]byte("["))
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(c.Response())
+	written := 0
+	err = StreamUserLinks(db, userId, func(link *globalstructs.Link, daily []globalstructs.DailyClicks) error {
+		if written > 0 {
+			if _, err := c.Response().Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+
+		tags := link.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		if daily == nil {
+			daily = []globalstructs.DailyClicks{}
+		}
+
+		err := encoder.Encode(exportLink{
+			Shortcode:     link.Shortcode,
+			ShortURL:      ShortURL(config, link.Domain, link.Shortcode),
+			URL:           link.Url,
+			CreatedAt:     formatExportTime(link.CreatedAt),
+			LastClickedAt: formatExportTime(link.LastClickedAt),
+			Clicks:        link.Clicks,
+			Tags:          tags,
+			ExpiresAt:     formatExportTime(link.ExpiresAt),
+			DailyClicks:   daily,
+		})
+		if err != nil {
+			return err
+		}
+
+		written++
+		if written%exportFlushInterval == 0 {
+			c.Response().Flush()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Response().Write([]byte("]\n"))
+	return err
+}
+
+/*
+* Function: formatExportTime
+*
+* Parameters: unix int64 - A unix time from the database
+*
+* Returns: string - The time formatted as RFC 3339 in UTC, or an empty string if the time is not set
+*
+* Description: Formats the optional timestamps of a link for an export
+ */
+func formatExportTime(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
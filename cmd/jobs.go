@@ -0,0 +1,136 @@
+/*
+* File: cmd/jobs.go
+*
+* Description: This file contains the background jobs that run alongside the web server, such as deleting links
+*              that the cleanup policies in the configuration say are no longer needed
+*
+ */
+
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+)
+
+// How often the cleanup job runs when the configuration does not say
+const defaultCleanupInterval = 60 * time.Minute
+
+/*
+* Struct: CleanupJob
+*
+* Description: The goroutine that applies the cleanup policies, kept so it can be stopped before the database is
+*              closed
+ */
+type CleanupJob struct {
+	stop chan struct{} // Closed to ask the job to stop
+	done chan struct{} // Closed by the job once it has stopped
+}
+
+/*
+* Function: StartCleanupJob
+*
+* Parameters: db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*             e      *echo.Echo   - The echo instance, used for logging
+*
+* Returns: *CleanupJob - The running job, nil if no policy is enabled
+*
+* Description: Starts a goroutine that applies the cleanup policies once at startup and then on every interval.
+*              Nothing is started when no policy is enabled
+ */
+func StartCleanupJob(db *sql.DB, config *conf.Config, e *echo.Echo) *CleanupJob {
+	cleanup := config.Cleanup
+	if cleanup.UnusedLinkDays <= 0 && cleanup.AnonymousMaxAgeDays <= 0 && cleanup.AnonymousInactiveDays <= 0 {
+		return nil
+	}
+
+	interval := defaultCleanupInterval
+	if config.Cleanup.IntervalMinutes > 0 {
+		interval = time.Duration(config.Cleanup.IntervalMinutes) * time.Minute
+	}
+
+	job := &CleanupJob{stop: make(chan struct{}), done: make(chan struct{})}
+
+	go func() {
+		defer close(job.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			runCleanup(db, config, e)
+
+			select {
+			case <-ticker.C:
+			case <-job.stop:
+				return
+			}
+		}
+	}()
+
+	return job
+}
+
+/*
+* Function: CleanupJob.Stop
+*
+* Parameters: None
+*
+* Returns: None
+*
+* Description: Stops the job, waiting for a run that is in progress to finish. Safe to call on a nil job
+ */
+func (job *CleanupJob) Stop() {
+	if job == nil {
+		return
+	}
+
+	close(job.stop)
+	<-job.done
+}
+
+/*
+* Function: runCleanup
+*
+* Parameters: db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*             e      *echo.Echo   - The echo instance, used for logging
+*
+* Returns: None
+*
+* Description: Applies each enabled cleanup policy once, logging how many links were deleted
+ */
+func runCleanup(db *sql.DB, config *conf.Config, e *echo.Echo) {
+	if config.Cleanup.UnusedLinkDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -config.Cleanup.UnusedLinkDays).Unix()
+		deleted, err := DeleteUnusedLinks(db, cutoff)
+		if err != nil {
+			e.Logger.Errorf("Could not delete unused links: %s", err.Error())
+		} else if deleted > 0 {
+			e.Logger.Infof("Deleted %d links unused for %d days", deleted, config.Cleanup.UnusedLinkDays)
+		}
+	}
+
+	if config.Cleanup.AnonymousMaxAgeDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -config.Cleanup.AnonymousMaxAgeDays).Unix()
+		deleted, err := DeleteOldAnonymousLinks(db, cutoff)
+		if err != nil {
+			e.Logger.Errorf("Could not delete old anonymous links: %s", err.Error())
+		} else if deleted > 0 {
+			e.Logger.Infof("Deleted %d anonymous links older than %d days", deleted, config.Cleanup.AnonymousMaxAgeDays)
+		}
+	}
+
+	if config.Cleanup.AnonymousInactiveDays > 0 {
+		cutoff := time.Now().AddDate(0, 0, -config.Cleanup.AnonymousInactiveDays).Unix()
+		deleted, err := DeleteUnusedAnonymousLinks(db, cutoff)
+		if err != nil {
+			e.Logger.Errorf("Could not delete unused anonymous links: %s", err.Error())
+		} else if deleted > 0 {
+			e.Logger.Infof("Deleted %d anonymous links unused for %d days", deleted, config.Cleanup.AnonymousInactiveDays)
+		}
+	}
+}
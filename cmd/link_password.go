@@ -0,0 +1,176 @@
+/*
+* File: cmd/link_password.go
+*
+* Description: This file contains the handlers for password protected links, which ask visitors for a password
+*              before redirecting them and let the owner of a link set or remove that password
+*
+ */
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+	"github.com/vtallen/go-link-shortener/internal/sessmngt"
+	"github.com/vtallen/go-link-shortener/pkg/codegen"
+	"github.com/vtallen/go-link-shortener/pkg/geoip"
+)
+
+// The number of wrong passwords a client may enter for one link before it has to wait
+const (
+	maxLinkPasswordAttempts   = 5
+	linkPasswordAttemptWindow = 15 * time.Minute
+)
+
+// bcrypt ignores everything after the first 72 bytes of a password
+const maxLinkPasswordLength = 72
+
+// Counts wrong passwords per client address and link
+var linkPasswordAttempts = sessmngt.NewAttemptLimiter(maxLinkPasswordAttempts, linkPasswordAttemptWindow)
+
+/*
+* Function: renderPasswordPrompt
+*
+* Parameters: c         echo.Context        - The context of the request
+*             config    *conf.Config        - The configuration for the application
+*             link      *globalstructs.Link - The protected link
+*             status    int                 - The http status to respond with
+*             errorText string              - The error to show above the form, empty for none
+*
+* Returns: error - If there is an error rendering the page
+*
+* Description: Renders the page asking for the password of a protected link. The destination is not included. The
+*              form is posted back to the url that was requested so any query string is passed through
+ */
+func renderPasswordPrompt(c echo.Context, config *conf.Config, link *globalstructs.Link, status int, errorText string) error {
+	data := globalstructs.LinkPasswordData{
+		FormAction: c.Request().URL.RequestURI(),
+		ShortURL:   ShortURL(config, link.Domain, link.Shortcode),
+		HasError:   errorText != "",
+		ErrorText:  errorText,
+		IsLoggedIn: sessmngt.ValidateSession(c) == nil,
+	}
+
+	return c.Render(status, "link-password", data)
+}
+
+/*
+* Function: HandleLinkPasswordSubmit
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*             geo    *geoip.DB    - The GeoIP database used by country rules, nil if none is configured
+*
+* Returns: error - If there is an error redirecting the user
+*
+* Description: Handles a POST request to /:shortcode, or /:shortcode/* for prefix links, from the password
+*              prompt. The visitor is redirected and the click counted only if the password is correct, wrong
+*              passwords are limited per client address
+*
+ */
+func HandleLinkPasswordSubmit(c echo.Context, config *conf.Config, geo *geoip.DB) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	shortcode := codegen.NormalizeCase(c.Param("shortcode"), config.Shortcodes.Universe)
+
+	link, err := GetLinkByShortcode(db, requestDomain(c, config), shortcode)
+	if err != nil {
+		errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+		return c.Render(http.StatusNotFound, "error-page", errData)
+	}
+
+	if pathSuffix(c) != "" && !acceptsPath(link) {
+		errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+		return c.Render(http.StatusNotFound, "error-page", errData)
+	}
+
+	if link.ExpiresAt != 0 && time.Now().Unix() >= link.ExpiresAt {
+		errData := globalstructs.ErrorPageData{ErrorText: "410, this link has expired"}
+		return c.Render(http.StatusGone, "error-page", errData)
+	}
+
+	// The password may have been removed since the prompt was shown
+	if link.PasswordHash == "" {
+		return c.Redirect(http.StatusSeeOther, c.Request().URL.RequestURI())
+	}
+
+	// The attempt is counted before bcrypt runs, so guesses sent in parallel cannot get past the limit
+	key := c.RealIP() + "|" + strconv.Itoa(link.ID)
+	if !linkPasswordAttempts.Attempt(key) {
+		return renderPasswordPrompt(c, config, link, http.StatusTooManyRequests, "Too many wrong passwords, try again later")
+	}
+
+	err = sessmngt.CheckPassword(link.PasswordHash, c.FormValue("password"))
+	if err != nil {
+		return renderPasswordPrompt(c, config, link, http.StatusUnauthorized, "Wrong password")
+	}
+	linkPasswordAttempts.Reset(key)
+
+	// 303 so the browser follows the redirect with a GET
+	return followLink(c, db, config, geo, link, http.StatusSeeOther)
+}
+
+/*
+* Function: HandleLinkPasswordSettings
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error saving the password or rendering the form
+*
+* Description: Handles a POST request to /user/link/:id/password from the settings page, setting the password of
+*              the link or removing it when the remove button was used
+*
+ */
+func HandleLinkPasswordSettings(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data := globalstructs.LinkSettingsData{Link: *link, ShortURL: ShortURL(config, link.Domain, link.Shortcode), IsLoggedIn: true}
+
+	hash := ""
+	if c.FormValue("action") != "remove" {
+		password := c.FormValue("password")
+		if password == "" || len(password) > maxLinkPasswordLength {
+			data.HasError = true
+			data.ErrorText = "The password must be between 1 and 72 characters"
+			return c.Render(http.StatusOK, "link-password-form", data)
+		}
+
+		hash, err = sessmngt.HashPassword(password)
+		if err != nil {
+			c.Logger().Errorf("Could not hash the password of link id %d: %s", link.ID, err.Error())
+			return c.String(http.StatusInternalServerError, "Internal server error")
+		}
+	}
+
+	err = SetLinkPassword(db, link.ID, hash)
+	if err != nil {
+		c.Logger().Errorf("Could not save the password of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data.Link.PasswordHash = hash
+	data.Saved = true
+	return c.Render(http.StatusOK, "link-password-form", data)
+}
@@ -0,0 +1,601 @@
+/*
+* File: cmd/link_settings.go
+*
+* Description: This file contains the handlers for the settings page of a single link, /user/link/:id, where the
+*              owner of a link can change how it behaves
+*
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+	"github.com/vtallen/go-link-shortener/pkg/useragent"
+)
+
+// Returned by getOwnedLink when the link does not exist or belongs to someone else
+var errLinkNotOwned = errors.New("link not found")
+
+/*
+* Function: HandleLinkSettingsPage
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error rendering the page
+*
+* Description: Handles a GET request to /user/link/:id, showing the settings of one of the user's links
+*
+ */
+func HandleLinkSettingsPage(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.Render(http.StatusNotFound, "error-page", globalstructs.ErrorPageData{ErrorText: "404, link does not exist", IsLoggedIn: true})
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	rules, err := GetLinkRules(db, link.ID)
+	if err != nil {
+		c.Logger().Errorf("Could not get the rules of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link.Variants, err = GetLinkVariants(db, link.ID)
+	if err != nil {
+		c.Logger().Errorf("Could not get the variants of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data := globalstructs.LinkSettingsData{
+		Link:         *link,
+		ShortURL:     ShortURL(config, link.Domain, link.Shortcode),
+		Rules:        rules,
+		Platforms:    useragent.Platforms,
+		GeoIPEnabled: config.GeoIP.Database != "",
+		IsLoggedIn:   true,
+	}
+	return c.Render(http.StatusOK, "link-settings", data)
+}
+
+/*
+* Function: HandleLinkSocialPreview
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error saving the settings or rendering the form
+*
+* Description: Handles a POST request to /user/link/:id/social from the settings page, saving the title,
+*              description and image shown to link preview crawlers. Leaving every field empty turns the social
+*              preview off
+*
+ */
+func HandleLinkSocialPreview(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link.OgTitle = strings.TrimSpace(c.FormValue("og-title"))
+	link.OgDescription = strings.TrimSpace(c.FormValue("og-description"))
+	link.OgImage = strings.TrimSpace(c.FormValue("og-image"))
+	data := globalstructs.LinkSettingsData{Link: *link, ShortURL: ShortURL(config, link.Domain, link.Shortcode), IsLoggedIn: true}
+
+	if len(link.OgTitle) > maxTitleLength || len(link.OgDescription) > maxDescriptionLength {
+		data.HasError = true
+		data.ErrorText = "The title or description is too long"
+		return c.Render(http.StatusOK, "social-preview-form", data)
+	}
+
+	if link.OgImage != "" {
+		image, err := url.Parse(link.OgImage)
+		if err != nil || (image.Scheme != "http" && image.Scheme != "https") || image.Host == "" {
+			data.HasError = true
+			data.ErrorText = "The image must be an http or https url"
+			return c.Render(http.StatusOK, "social-preview-form", data)
+		}
+	}
+
+	err = UpdateLinkSocialPreview(db, link.ID, link.OgTitle, link.OgDescription, link.OgImage)
+	if err != nil {
+		c.Logger().Errorf("Could not save the social preview of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data.Saved = true
+	return c.Render(http.StatusOK, "social-preview-form", data)
+}
+
+/*
+* Function: HandleLinkPassthrough
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error saving the setting or rendering the form
+*
+* Description: Handles a POST request to /user/link/:id/passthrough from the settings page, changing what is done
+*              with the query string of the short link
+*
+ */
+func HandleLinkPassthrough(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data := globalstructs.LinkSettingsData{Link: *link, ShortURL: ShortURL(config, link.Domain, link.Shortcode), IsLoggedIn: true}
+
+	mode := c.FormValue("passthrough")
+	if !isPassthroughMode(mode) {
+		data.HasError = true
+		data.ErrorText = "Unknown query string option"
+		return c.Render(http.StatusOK, "link-passthrough-form", data)
+	}
+
+	err = SetLinkPassthroughMode(db, link.ID, mode)
+	if err != nil {
+		c.Logger().Errorf("Could not save the passthrough mode of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data.Link.PassthroughMode = mode
+	data.Saved = true
+	return c.Render(http.StatusOK, "link-passthrough-form", data)
+}
+
+/*
+* Function: HandleLinkPrefixMode
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error saving the setting or rendering the form
+*
+* Description: Handles a POST request to /user/link/:id/prefix from the settings page, turning path forwarding on
+*              when the prefix checkbox is checked and off otherwise
+*
+ */
+func HandleLinkPrefixMode(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link.PrefixMode = c.FormValue("prefix") == "on"
+	err = SetLinkPrefixMode(db, link.ID, link.PrefixMode)
+	if err != nil {
+		c.Logger().Errorf("Could not save the prefix mode of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data := globalstructs.LinkSettingsData{Link: *link, ShortURL: ShortURL(config, link.Domain, link.Shortcode), Saved: true, IsLoggedIn: true}
+	return c.Render(http.StatusOK, "link-prefix-form", data)
+}
+
+/*
+* Function: HandleAddLinkRule
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error saving the rule or rendering the list
+*
+* Description: Handles a POST request to /user/link/:id/rules from the settings page, adding a redirect rule
+*              after the existing ones
+*
+ */
+func HandleAddLinkRule(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	rules, err := GetLinkRules(db, link.ID)
+	if err != nil {
+		c.Logger().Errorf("Could not get the rules of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+	if len(rules) >= maxLinkRules {
+		return renderLinkRules(c, db, config, link, "A link can have at most "+strconv.Itoa(maxLinkRules)+" rules")
+	}
+
+	kind := c.FormValue("kind")
+	value, err := normalizeRuleValue(kind, c.FormValue("value"))
+	if err != nil {
+		return renderLinkRules(c, db, config, link, "Invalid rule: "+err.Error())
+	}
+
+	destination := strings.TrimSpace(c.FormValue("url"))
+	err = validateDestination(config, destination)
+	if err != nil {
+		return renderLinkRules(c, db, config, link, "Invalid destination: "+err.Error())
+	}
+
+	rule := globalstructs.LinkRule{LinkId: link.ID, Kind: kind, Value: value, Url: destination}
+	err = InsertLinkRule(db, &rule)
+	if err != nil {
+		c.Logger().Errorf("Could not add a rule to link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return renderLinkRules(c, db, config, link, "")
+}
+
+/*
+* Function: HandleChangeLinkRule
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error changing the rule or rendering the list
+*
+* Description: Handles a POST request to /user/link/:id/rules/:rule/:action from the settings page, where action
+*              is "up" to check the rule before the one above it or "delete" to remove it
+*
+ */
+func HandleChangeLinkRule(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	ruleId, err := strconv.Atoi(c.Param("rule"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "Rule not found")
+	}
+
+	switch c.Param("action") {
+	case "up":
+		err = MoveLinkRuleUp(db, link.ID, ruleId)
+	case "delete":
+		err = DeleteLinkRule(db, link.ID, ruleId)
+	default:
+		return c.String(http.StatusNotFound, "Not found")
+	}
+
+	if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "Rule not found")
+	} else if err != nil {
+		c.Logger().Errorf("Could not change rule id %d of link id %d: %s", ruleId, link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return renderLinkRules(c, db, config, link, "")
+}
+
+/*
+* Function: renderLinkRules
+*
+* Parameters: c         echo.Context        - The context of the request
+*             db        *sql.DB             - A pointer to the database object
+*             config    *conf.Config        - The configuration for the application
+*             link      *globalstructs.Link - The link whose rules are shown
+*             errorText string              - The error to show below the list, empty for none
+*
+* Returns: error - If there is an error rendering the list
+*
+* Description: Renders the rules section of the settings page after it was changed
+ */
+func renderLinkRules(c echo.Context, db *sql.DB, config *conf.Config, link *globalstructs.Link, errorText string) error {
+	rules, err := GetLinkRules(db, link.ID)
+	if err != nil {
+		c.Logger().Errorf("Could not get the rules of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data := globalstructs.LinkSettingsData{
+		Link:         *link,
+		ShortURL:     ShortURL(config, link.Domain, link.Shortcode),
+		Rules:        rules,
+		Platforms:    useragent.Platforms,
+		GeoIPEnabled: config.GeoIP.Database != "",
+		HasError:     errorText != "",
+		ErrorText:    errorText,
+		IsLoggedIn:   true,
+	}
+	return c.Render(http.StatusOK, "link-rules", data)
+}
+
+/*
+* Function: HandleAddLinkVariant
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error saving the variant or rendering the list
+*
+* Description: Handles a POST request to /user/link/:id/variants from the settings page, adding a destination
+*              the link splits its traffic between
+*
+ */
+func HandleAddLinkVariant(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	variants, err := GetLinkVariants(db, link.ID)
+	if err != nil {
+		c.Logger().Errorf("Could not get the variants of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+	if len(variants) >= maxLinkVariants {
+		return renderLinkVariants(c, db, config, link, "A link can have at most "+strconv.Itoa(maxLinkVariants)+" variants")
+	}
+
+	destination := strings.TrimSpace(c.FormValue("url"))
+	err = validateDestination(config, destination)
+	if err != nil {
+		return renderLinkVariants(c, db, config, link, "Invalid destination: "+err.Error())
+	}
+
+	weight, err := parseVariantWeight(c.FormValue("weight"))
+	if err != nil {
+		return renderLinkVariants(c, db, config, link, "Invalid variant: "+err.Error())
+	}
+
+	variant := globalstructs.LinkVariant{LinkId: link.ID, Url: destination, Weight: weight}
+	err = InsertLinkVariant(db, &variant)
+	if err != nil {
+		c.Logger().Errorf("Could not add a variant to link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return renderLinkVariants(c, db, config, link, "")
+}
+
+/*
+* Function: HandleChangeLinkVariant
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error changing the variant or rendering the list
+*
+* Description: Handles a POST request to /user/link/:id/variants/:variant/:action from the settings page, where
+*              action is "weight" to change the share of traffic the variant gets or "delete" to remove it
+*
+ */
+func HandleChangeLinkVariant(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	variantId, err := strconv.Atoi(c.Param("variant"))
+	if err != nil {
+		return c.String(http.StatusNotFound, "Variant not found")
+	}
+
+	switch c.Param("action") {
+	case "weight":
+		weight, parseErr := parseVariantWeight(c.FormValue("weight"))
+		if parseErr != nil {
+			return renderLinkVariants(c, db, config, link, "Invalid variant: "+parseErr.Error())
+		}
+		err = SetLinkVariantWeight(db, link.ID, variantId, weight)
+	case "delete":
+		err = DeleteLinkVariant(db, link.ID, variantId)
+	default:
+		return c.String(http.StatusNotFound, "Not found")
+	}
+
+	if err == sql.ErrNoRows {
+		return c.String(http.StatusNotFound, "Variant not found")
+	} else if err != nil {
+		c.Logger().Errorf("Could not change variant id %d of link id %d: %s", variantId, link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return renderLinkVariants(c, db, config, link, "")
+}
+
+/*
+* Function: HandleLinkStickyVariants
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error saving the setting or rendering the list
+*
+* Description: Handles a POST request to /user/link/:id/variants/sticky from the settings page, turning sticky
+*              variants on when the sticky checkbox is checked and off otherwise
+*
+ */
+func HandleLinkStickyVariants(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link, err := getOwnedLink(c, db)
+	if err == errLinkNotOwned {
+		return c.String(http.StatusNotFound, "Link not found")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	link.StickyVariants = c.FormValue("sticky") == "on"
+	err = SetLinkStickyVariants(db, link.ID, link.StickyVariants)
+	if err != nil {
+		c.Logger().Errorf("Could not save sticky variants of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return renderLinkVariants(c, db, config, link, "")
+}
+
+/*
+* Function: parseVariantWeight
+*
+* Parameters: raw string - The weight as entered by the user, empty for the default of 1
+*
+* Returns: int   - The weight
+*          error - A message describing why the weight cannot be used
+*
+* Description: Checks the weight of a variant before it is saved
+ */
+func parseVariantWeight(raw string) (int, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 1, nil
+	}
+
+	weight, err := strconv.Atoi(raw)
+	if err != nil || weight < 0 || weight > maxVariantWeight {
+		return 0, errors.New("weight must be a whole number from 0 to " + strconv.Itoa(maxVariantWeight))
+	}
+
+	return weight, nil
+}
+
+/*
+* Function: renderLinkVariants
+*
+* Parameters: c         echo.Context        - The context of the request
+*             db        *sql.DB             - A pointer to the database object
+*             config    *conf.Config        - The configuration for the application
+*             link      *globalstructs.Link - The link whose variants are shown
+*             errorText string              - The error to show below the list, empty for none
+*
+* Returns: error - If there is an error rendering the list
+*
+* Description: Renders the variants section of the settings page after it was changed
+ */
+func renderLinkVariants(c echo.Context, db *sql.DB, config *conf.Config, link *globalstructs.Link, errorText string) error {
+	var err error
+	link.Variants, err = GetLinkVariants(db, link.ID)
+	if err != nil {
+		c.Logger().Errorf("Could not get the variants of link id %d: %s", link.ID, err.Error())
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	data := globalstructs.LinkSettingsData{
+		Link:       *link,
+		ShortURL:   ShortURL(config, link.Domain, link.Shortcode),
+		HasError:   errorText != "",
+		ErrorText:  errorText,
+		IsLoggedIn: true,
+	}
+	return c.Render(http.StatusOK, "link-variants", data)
+}
+
+/*
+* Function: getOwnedLink
+*
+* Parameters: c  echo.Context - The context of the request, with the link id in the :id path parameter
+*             db *sql.DB      - A pointer to the database object
+*
+* Returns: *globalstructs.Link - The link, if it belongs to the logged in user
+*          error               - errLinkNotOwned if the link does not exist or belongs to another user, any other
+*                                error is logged
+*
+* Description: Looks up the link a settings request is for and checks that the logged in user owns it
+ */
+func getOwnedLink(c echo.Context, db *sql.DB) (*globalstructs.Link, error) {
+	sess, err := session.Get("session", c)
+	if err != nil {
+		c.Logger().Errorf("Could not get session from context: %s\n", err.Error())
+		return nil, err
+	}
+
+	userId, ok := sess.Values["userId"].(int)
+	if !ok {
+		c.Logger().Errorf("Could not convert the session userId to int.\n")
+		return nil, errors.New("invalid session")
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, errLinkNotOwned
+	}
+
+	link, err := GetLink(db, id)
+	if err == sql.ErrNoRows {
+		return nil, errLinkNotOwned
+	} else if err != nil {
+		c.Logger().Errorf("Could not get link id %d: %s", id, err.Error())
+		return nil, err
+	}
+
+	if link.UserId != userId {
+		return nil, errLinkNotOwned
+	}
+
+	return link, nil
+}
@@ -0,0 +1,237 @@
+/*
+* File: cmd/listeners.go
+*
+* Description: This file contains how the server is reached. It serves HTTPS with its own certificate, or plain
+*              HTTP behind a reverse proxy that terminates TLS, with an optional second listener that redirects
+*              HTTP to HTTPS. Only the proxies listed in server.trusted_proxies are believed about the address and
+*              scheme of the client
+*
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+/*
+* Function: parseTrustedProxies
+*
+* Parameters: entries []string - Addresses or CIDR ranges from server.trusted_proxies
+*
+* Returns: []*net.IPNet - The ranges of the trusted proxies, a single address becomes a range of one
+*          error        - If an entry is neither an address nor a range
+*
+* Description: Parses the trusted proxies once at startup
+ */
+func parseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry += "/" + strconv.Itoa(bits)
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+/*
+* Function: newIPExtractor
+*
+* Parameters: proxies []*net.IPNet - The trusted proxies
+*
+* Returns: echo.IPExtractor - How c.RealIP finds the address of the client
+*
+* Description: Without trusted proxies the address of the connection is used and X-Forwarded-For is ignored, as
+*              anyone could send it. Otherwise X-Forwarded-For is read back to the first address that is not a
+*              trusted proxy. The loopback and private ranges echo trusts by default are only trusted if listed
+ */
+func newIPExtractor(proxies []*net.IPNet) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+/*
+* Function: fromTrustedProxy
+*
+* Parameters: remoteAddr string       - The address of the connection, host:port
+*             proxies    []*net.IPNet - The trusted proxies
+*
+* Returns: bool - true if the connection came from one of the trusted proxies
+*
+* Description: Used to decide whether the X-Forwarded-Proto header of a request can be believed
+ */
+func fromTrustedProxy(remoteAddr string, proxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Function: httpsMiddleware
+*
+* Parameters: proxies []*net.IPNet - The trusted proxies
+*
+* Returns: echo.MiddlewareFunc - A middleware function that records whether the request was made over HTTPS
+*
+* Description: A request was made over HTTPS if the server terminated TLS itself, or if a trusted proxy says so with
+*              X-Forwarded-Proto. Handlers read the result with isHTTPS. HTTPS responses get the HSTS header when
+*              server.hsts_max_age is set, browsers ignore it over plain HTTP. Must be registered after
+*              configMiddleware
+ */
+func httpsMiddleware(proxies []*net.IPNet) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			https := c.IsTLS()
+			if !https && fromTrustedProxy(c.Request().RemoteAddr, proxies) {
+				https = strings.EqualFold(c.Request().Header.Get(echo.HeaderXForwardedProto), "https")
+			}
+			c.Set("https", https)
+
+			if maxAge := requestConfig(c).Server.HSTSMaxAge; https && maxAge > 0 {
+				c.Response().Header().Set(echo.HeaderStrictTransportSecurity, "max-age="+strconv.Itoa(maxAge))
+			}
+
+			return next(c)
+		}
+	}
+}
+
+/*
+* Function: isHTTPS
+*
+* Parameters: c echo.Context - The context of the request
+*
+* Returns: bool - true if the client reached the server over HTTPS
+*
+* Description: Reads what httpsMiddleware recorded, used to mark cookies as secure
+ */
+func isHTTPS(c echo.Context) bool {
+	https, _ := c.Get("https").(bool)
+	return https
+}
+
+/*
+* Function: startRedirectListener
+*
+* Parameters: e       *echo.Echo        - The web server, used for logging
+*             config  *conf.Config      - The configuration for the application
+*             manager *autocert.Manager - The ACME manager, nil if certificates come from files
+*
+* Returns: *http.Server - The listener, so it can be shut down
+*
+* Description: Answers plain HTTP on server.redirect_port by redirecting to the same path over HTTPS. The Host of
+*              the request is only kept if it is the default host or one of server.domains, so the listener cannot
+*              be used to redirect to other sites. With ACME it also answers the CA's http-01 challenges
+ */
+func startRedirectListener(e *echo.Echo, config *conf.Config, manager *autocert.Manager) *http.Server {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if !strings.EqualFold(host, config.Server.Host) && configuredDomain(config, host) == "" {
+			host = config.Server.Host
+		}
+
+		// Behind a proxy the HTTPS port is the proxy's, which is assumed to be the default one
+		if !config.Server.PlainHTTP && config.Server.Port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(config.Server.Port))
+		}
+
+		// 308 keeps the method and body of requests that are not a GET
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+	if manager != nil {
+		handler = manager.HTTPHandler(handler)
+	}
+
+	server := &http.Server{
+		Addr:              ":" + strconv.Itoa(config.Server.RedirectPort),
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler:           handler,
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			e.Logger.Errorf("The HTTP redirect listener stopped. Error: %s", err.Error())
+		}
+	}()
+
+	return server
+}
+
+/*
+* Function: startServer
+*
+* Parameters: e       *echo.Echo        - The web server
+*             config  *conf.Config      - The configuration for the application
+*             manager *autocert.Manager - The ACME manager, nil to use auth.tls_cert and auth.tls_key
+*
+* Returns: error - Why the server stopped
+*
+* Description: Serves the application on server.port, over plain HTTP when server.plain_http is set and over HTTPS
+*              otherwise
+ */
+func startServer(e *echo.Echo, config *conf.Config, manager *autocert.Manager) error {
+	address := ":" + strconv.Itoa(config.Server.Port)
+	if config.Server.PlainHTTP {
+		return e.Start(address)
+	}
+
+	tlsConfig, err := newTLSConfig(e, config, manager)
+	if err != nil {
+		return err
+	}
+
+	e.TLSServer.Addr = address
+	e.TLSServer.TLSConfig = tlsConfig
+	return e.StartServer(e.TLSServer)
+}
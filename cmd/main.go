@@ -9,16 +9,21 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"html/template"
 	"io"
+	"net/http"
 	"os"
-	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/sessions"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/vtallen/go-link-shortener/internal/conf"
 	"github.com/vtallen/go-link-shortener/internal/globalstructs"
 	"github.com/vtallen/go-link-shortener/internal/sessmngt"
+	"github.com/vtallen/go-link-shortener/pkg/geoip"
+	"github.com/vtallen/go-link-shortener/pkg/urlutil"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -29,11 +34,18 @@ import (
 /*
 * Struct: Templates
 *
-* Description: This struct is used to store the html templates for the web server that get ingested at startup
+* Description: This struct is used to store the html templates for the web server that get ingested at startup.
+*              The templates are swapped as a whole when they are reloaded, so a page never renders with a mix
 *
  */
 type Templates struct {
-	templates *template.Template
+	templates atomic.Pointer[template.Template]
+}
+
+// Functions that can be called from the html templates
+var templateFuncs = template.FuncMap{
+	"formatDate": formatDate,
+	"isTemplate": urlutil.IsTemplate,
 }
 
 /*
@@ -47,9 +59,59 @@ type Templates struct {
 *
  */
 func newTemplate() *Templates {
-	return &Templates{
-		templates: template.Must(template.ParseGlob("views/*.html")),
+	t := &Templates{}
+	t.templates.Store(template.Must(parseTemplates()))
+	return t
+}
+
+/*
+* Function: parseTemplates
+*
+* Parameters: None
+*
+* Returns: *template.Template - The parsed templates of the views folder
+*          error              - If a template cannot be read or parsed
+*
+* Description: Parses every html template in the views folder with the template functions available
+ */
+func parseTemplates() (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).ParseGlob("views/*.html")
+}
+
+/*
+* Function: Templates.Reload
+*
+* Parameters: None
+*
+* Returns: error - If the templates cannot be parsed, the current templates are kept
+*
+* Description: Parses the views folder again and swaps in the new templates, requests already rendering finish
+*              with the old ones
+ */
+func (t *Templates) Reload() error {
+	templates, err := parseTemplates()
+	if err != nil {
+		return err
 	}
+
+	t.templates.Store(templates)
+	return nil
+}
+
+/*
+* Function: formatDate
+*
+* Parameters: unix int64 - A unix time from the database
+*
+* Returns: string - The date in UTC as YYYY-MM-DD, or an empty string if the time is not set
+*
+* Description: Formats the timestamps of a link for display in the templates
+ */
+func formatDate(unix int64) string {
+	if unix == 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format("2006-01-02")
 }
 
 /*
@@ -64,7 +126,7 @@ func newTemplate() *Templates {
 * Description: This function is used to render the html templates to the client
  */
 func (t *Templates) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	return t.templates.ExecuteTemplate(w, name, data)
+	return t.templates.Load().ExecuteTemplate(w, name, data)
 }
 
 /*
@@ -93,9 +155,13 @@ func stringToLogLevel(llstring string) log.Lvl {
 }
 
 func main() {
-	config, err := conf.LoadConfig("config.yaml")
+	configPath := flag.String("config", "config.yaml", "Path to the configuration file")
+	flag.Usage = func() { printUsage(flag.CommandLine.Output()) }
+	flag.Parse()
+
+	config, err := conf.LoadConfig(*configPath)
 	if err != nil {
-		panic("Could not load configuration file config.yaml, Error: " + err.Error())
+		panic("Could not load configuration file " + *configPath + ", Error: " + err.Error())
 	}
 
 	// Setup database connection
@@ -103,13 +169,19 @@ func main() {
 	if err != nil {
 		panic("Could not setup database, Error: " + err.Error())
 	}
-	defer db.Close()
 
 	e := echo.New() // Create the web server
 
 	// Initalize tables in the database
 	SetupDB(db, e)
 
+	// Run a maintenance command instead of the server if one was given
+	if flag.NArg() > 0 {
+		code := RunCommand(flag.Args(), db, config)
+		db.Close()
+		os.Exit(code)
+	}
+
 	file, err := os.OpenFile(config.Logging.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		panic("Filed to open log file: " + config.Logging.LogFile + " Error: " + err.Error())
@@ -124,36 +196,50 @@ func main() {
 	// Setup the logger middleware
 	e.Use(middleware.Logger())
 
+	// Only the configured reverse proxies are believed about the address and scheme of the client
+	proxies, err := parseTrustedProxies(config.Server.TrustedProxies)
+	if err != nil {
+		e.Logger.Fatalf("Invalid server.trusted_proxies. Error: %s", err.Error())
+	}
+	e.IPExtractor = newIPExtractor(proxies)
+
+	// Requests read the configuration from this, SIGHUP replaces it with a reloaded copy. config itself is never
+	// modified, so the listeners and background jobs can keep using it
+	var liveConfig atomic.Pointer[conf.Config]
+	liveConfig.Store(config)
+
 	// Setup middleware
 	e.Use(middleware.Logger())
-	e.Use(dbMiddleware(db)) // Injects the database variable into the request context
+	e.Use(configMiddleware(&liveConfig)) // Injects the configuration of the request into the context
+	e.Use(httpsMiddleware(proxies))      // Records whether the request was made over HTTPS and sends HSTS
+	e.Use(dbMiddleware(db))              // Injects the database variable into the request context
 	e.Use(session.Middleware(sessions.NewCookieStore([]byte(config.Auth.CookieSecret))))
 
 	e.Static("/images", "images")
 	e.Static("/css", "css")
 
-	e.Renderer = newTemplate() // Load the templates
+	templates := newTemplate() // Load the templates
+	e.Renderer = templates
+
+	cleanupJob := StartCleanupJob(db, config, e)
+	metadataQueue := StartMetadataQueue(db, config, e)
+
+	// Load the GeoIP database used by country rules, without one they never match
+	var geo *geoip.DB
+	if config.GeoIP.Database != "" {
+		geo, err = geoip.Open(config.GeoIP.Database)
+		if err != nil {
+			e.Logger.Fatalf("Could not load the GeoIP database %s. Error: %s", config.GeoIP.Database, err.Error())
+		}
+		e.Logger.Infof("Loaded %d ranges from the GeoIP database", geo.Len())
+	}
 
 	// Setup data structs for the different pages
-	indexData := globalstructs.IndexData{}
-	indexData.Server = &config.Server
 	errorPageData := globalstructs.ErrorPageData{ErrorText: "No error"}
 
 	// Serve the index page
 	e.GET("/", func(c echo.Context) error {
-		indexData.ShortcodeForm.URL = ""
-		indexData.ShortcodeForm.Result = ""
-		indexData.ShortcodeForm.HasError = false
-		indexData.HCaptchaSiteKey = config.HCaptcha.SiteKey
-
-		// The navbar changes based on if a user is logged in or not, this enables the functionality
-		indexData.IsLoggedIn = false
-		err := sessmngt.ValidateSession(c)
-		if err == nil {
-			indexData.IsLoggedIn = true
-		}
-
-		return c.Render(200, "index", indexData)
+		return c.Render(200, "index", newIndexData(c, requestConfig(c)))
 	})
 
 	// Page to display errors on
@@ -170,17 +256,51 @@ func main() {
 
 	// Endpoint for the link creation form
 	e.POST("/create", func(c echo.Context) error {
-		return HandleAddLink(c, config, &indexData)
+		return HandleAddLink(c, requestConfig(c), metadataQueue)
 	})
 
+	// Endpoints that create many links at once from an uploaded CSV, the form on /user and the API
+	// share a handler that responds with a CSV of the results
+	e.POST("/user/bulk", func(c echo.Context) error {
+		return HandleBulkCreate(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware, middleware.BodyLimit("5M"))
+
+	e.POST("/api/links/bulk", func(c echo.Context) error {
+		return HandleBulkCreate(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware, middleware.BodyLimit("5M"))
+
 	// Endpoint that handles link deletion from the /user endpoint page
 	e.POST("/delete", func(c echo.Context) error {
 		return HandleDeleteLink(c)
 	}, sessmngt.SessionMiddleware)
 
+	// Shows where a link goes without following it, /:shortcode+ is handled by the redirect endpoint
+	e.GET("/:shortcode/preview", func(c echo.Context) error {
+		return HandlePreview(c, requestConfig(c))
+	})
+
+	// Serves a QR code of the short url as a PNG or SVG image
+	e.GET("/:shortcode/qr", func(c echo.Context) error {
+		return HandleQRCode(c, requestConfig(c))
+	})
+
 	// Endpoint that redirects the user to the stored url if it exists
 	e.GET("/:shortcode", func(c echo.Context) error {
-		return HandleRedirect(c, config)
+		return HandleRedirect(c, requestConfig(c), geo)
+	})
+
+	// Endpoint that checks the password of a protected link and redirects the user if it is correct
+	e.POST("/:shortcode", func(c echo.Context) error {
+		return HandleLinkPasswordSubmit(c, requestConfig(c), geo)
+	})
+
+	// Prefix links forward the rest of the path, /:shortcode/preview and /:shortcode/qr take priority
+	e.GET("/:shortcode/*", func(c echo.Context) error {
+		return HandleRedirect(c, requestConfig(c), geo)
+	})
+
+	e.POST("/:shortcode/*", func(c echo.Context) error {
+		return HandleLinkPasswordSubmit(c, requestConfig(c), geo)
 	})
 
 	loginData := globalstructs.LoginData{} // Data used by login/register pages
@@ -189,7 +309,7 @@ func main() {
 		loginData.HasError = false
 		loginData.ErrorText = ""
 		loginData.LoginForm.Email = ""
-		loginData.HCaptchaSiteKey = config.HCaptcha.SiteKey
+		loginData.HCaptchaSiteKey = requestConfig(c).HCaptcha.SiteKey
 
 		// The navbar changes based on if a user is logged in or not, this enables the functionality
 		loginData.IsLoggedIn = false
@@ -198,17 +318,17 @@ func main() {
 			loginData.IsLoggedIn = true
 		}
 
-		return sessmngt.HandleLoginPage(c, &loginData, config)
+		return sessmngt.HandleLoginPage(c, &loginData, requestConfig(c))
 	})
 
 	// Endpoint that handles the submission of the login form on /login
 	e.POST("/login", func(c echo.Context) error {
-		return sessmngt.HandleLoginSession(c, &loginData, config)
+		return sessmngt.HandleLoginSession(c, &loginData, requestConfig(c))
 	})
 
 	// Endpoint that logs the user out and redirects them to the login page
 	e.GET("/logout", func(c echo.Context) error {
-		return sessmngt.HandleLogout(c, config)
+		return sessmngt.HandleLogout(c, requestConfig(c))
 	})
 
 	// Endpoint that serves the register page
@@ -218,7 +338,7 @@ func main() {
 		registerData.ErrorText = ""
 		registerData.IsLoggedIn = false
 		registerData.Success = false
-		registerData.HCaptchaSiteKey = config.HCaptcha.SiteKey
+		registerData.HCaptchaSiteKey = requestConfig(c).HCaptcha.SiteKey
 
 		// The navbar changes based on if a user is logged in or not, this enables the functionality
 		registerData.IsLoggedIn = false
@@ -227,31 +347,108 @@ func main() {
 			registerData.IsLoggedIn = true
 		}
 
-		return sessmngt.HandleRegisterPage(c, &registerData, config)
+		return sessmngt.HandleRegisterPage(c, &registerData, requestConfig(c))
 	})
 
 	// Endpoint that handles the submission of the register form on /register
 	e.POST("/register", func(c echo.Context) error {
-		return sessmngt.HandleRegisterSession(c, &registerData, config)
+		return sessmngt.HandleRegisterSession(c, &registerData, requestConfig(c))
 	})
 
-	// Endpoint for the user dashboard
-	userPageData := globalstructs.UserPageData{}
+	// Endpoint for the user dashboard. The page data holds the user's links, so every request gets its own
 	e.GET("/user", func(c echo.Context) error {
-		userPageData.IsLoggedIn = true // We can assume that this is the case as sessmngt.SessionMiddleware will only allow authenticated users
+		config := requestConfig(c)
+		// We can assume that the user is logged in as sessmngt.SessionMiddleware will only allow authenticated users
+		userPageData := globalstructs.UserPageData{Server: &config.Server, IsLoggedIn: true}
 		return HandleUserPage(c, &userPageData, config)
 	}, sessmngt.SessionMiddleware)
 
-	e.GET("/about", func(c echo.Context) error {
-		// The navbar changes based on if a user is logged in or not, this enables the functionality
-		indexData.IsLoggedIn = false
-		err := sessmngt.ValidateSession(c)
-		if err == nil {
-			indexData.IsLoggedIn = true
-		}
+	// Endpoint that htmx uses to reload the rows of the links table when searching, filtering or changing page
+	e.GET("/user/links", func(c echo.Context) error {
+		userPageData := globalstructs.UserPageData{Server: &requestConfig(c).Server, IsLoggedIn: true}
+		return HandleUserLinkRows(c, &userPageData)
+	}, sessmngt.SessionMiddleware)
+
+	// Endpoint that downloads all of the user's links and statistics as CSV or JSON
+	e.GET("/user/export", func(c echo.Context) error {
+		return HandleExport(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
 
-		return c.Render(200, "about", indexData)
+	// Endpoints used by anonymous creators to move a link into their account
+	e.GET("/claim", func(c echo.Context) error {
+		return HandleClaimPage(c, requestConfig(c))
 	})
 
-	e.Logger.Fatal(e.StartTLS(":"+strconv.Itoa(config.Server.Port), config.Auth.TLSCert, config.Auth.TLSKey)) // Run the server
+	e.POST("/claim", func(c echo.Context) error {
+		return HandleClaimLink(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	// Endpoints for the settings page of a single link
+	e.GET("/user/link/:id", func(c echo.Context) error {
+		return HandleLinkSettingsPage(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/social", func(c echo.Context) error {
+		return HandleLinkSocialPreview(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/passthrough", func(c echo.Context) error {
+		return HandleLinkPassthrough(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/prefix", func(c echo.Context) error {
+		return HandleLinkPrefixMode(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/fallback", func(c echo.Context) error {
+		return HandleLinkFallback(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/password", func(c echo.Context) error {
+		return HandleLinkPasswordSettings(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/rules", func(c echo.Context) error {
+		return HandleAddLinkRule(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/rules/:rule/:action", func(c echo.Context) error {
+		return HandleChangeLinkRule(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/variants", func(c echo.Context) error {
+		return HandleAddLinkVariant(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/variants/sticky", func(c echo.Context) error {
+		return HandleLinkStickyVariants(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.POST("/user/link/:id/variants/:variant/:action", func(c echo.Context) error {
+		return HandleChangeLinkVariant(c, requestConfig(c))
+	}, sessmngt.SessionMiddleware)
+
+	e.GET("/about", func(c echo.Context) error {
+		return c.Render(200, "about", newIndexData(c, requestConfig(c)))
+	})
+
+	// Certificates come from an ACME certificate authority when enabled, otherwise from auth.tls_cert and auth.tls_key
+	acmeManager, err := newACMEManager(config)
+	if err != nil {
+		e.Logger.Fatalf("Could not set up ACME. Error: %s", err.Error())
+	}
+
+	var redirectServer *http.Server
+	if config.Server.RedirectPort > 0 {
+		redirectServer = startRedirectListener(e, config, acmeManager)
+	}
+
+	// Run the server until SIGINT or SIGTERM, then let the requests in progress finish before closing the database
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- startServer(e, config, acmeManager)
+	}()
+
+	waitForSignals(e, *configPath, &liveConfig, templates, serverErr)
+	shutdown(e, config, redirectServer, cleanupJob, metadataQueue, db)
 }
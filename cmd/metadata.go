@@ -0,0 +1,199 @@
+/*
+* File: cmd/metadata.go
+*
+* Description: This file contains the background queue that fetches the title, description and icon of the pages
+*              links point to, so that the user page can show more than the raw url
+*
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/pkg/metafetch"
+)
+
+// The number of links that can be waiting to be fetched, links added while the queue is full are skipped
+const metadataQueueSize = 1000
+
+/*
+* Struct: MetadataQueue
+*
+* Description: A queue of link ids whose destination metadata should be fetched, worked on by a fixed number of
+*              goroutines
+ */
+type MetadataQueue struct {
+	db      *sql.DB
+	fetcher *metafetch.Fetcher
+	timeout time.Duration
+	logger  echo.Logger
+
+	ctx    context.Context // Cancelled when Stop gives up waiting, which abandons the fetches in progress
+	cancel context.CancelFunc
+
+	mu      sync.Mutex // Guards closed and sending on jobs
+	closed  bool
+	jobs    chan int
+	workers sync.WaitGroup
+}
+
+/*
+* Function: StartMetadataQueue
+*
+* Parameters: db     *sql.DB      - A pointer to the database object
+*             config *conf.Config - The configuration for the application
+*             e      *echo.Echo   - The echo instance, used for logging
+*
+* Returns: *MetadataQueue - The running queue, nil if fetching metadata is disabled
+*
+* Description: Creates the metadata queue and starts its workers
+ */
+func StartMetadataQueue(db *sql.DB, config *conf.Config, e *echo.Echo) *MetadataQueue {
+	if !config.Metadata.Enabled {
+		return nil
+	}
+
+	timeout := metafetch.DefaultTimeout
+	if config.Metadata.TimeoutSeconds > 0 {
+		timeout = time.Duration(config.Metadata.TimeoutSeconds) * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := &MetadataQueue{
+		db: db,
+		fetcher: metafetch.New(metafetch.Options{
+			Timeout:      timeout,
+			MaxBytes:     config.Metadata.MaxBytes,
+			AllowPrivate: config.Metadata.AllowPrivate,
+		}),
+		timeout: timeout,
+		logger:  e.Logger,
+		ctx:     ctx,
+		cancel:  cancel,
+		jobs:    make(chan int, metadataQueueSize),
+	}
+
+	workers := config.Metadata.Workers
+	if workers <= 0 {
+		workers = 2
+	}
+	for i := 0; i < workers; i++ {
+		queue.workers.Add(1)
+		go queue.work()
+	}
+
+	return queue
+}
+
+/*
+* Function: MetadataQueue.Enqueue
+*
+* Parameters: linkId int - The id of the link to fetch metadata for
+*
+* Returns: bool - false if the queue is disabled, stopped or full and the link was skipped
+*
+* Description: Adds a link to the queue without waiting. A nil queue accepts nothing, so callers do not need to
+*              check whether fetching metadata is enabled
+ */
+func (q *MetadataQueue) Enqueue(linkId int) bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+
+	select {
+	case q.jobs <- linkId:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+* Function: MetadataQueue.Stop
+*
+* Parameters: ctx context.Context - How long to wait for the links already in the queue
+*
+* Returns: error - ctx.Err() if the queue was not finished in time, the remaining links are left without metadata
+*
+* Description: Stops accepting links and waits for the workers to finish the links already in the queue. Once it
+*              returns the workers no longer use the database
+ */
+func (q *MetadataQueue) Stop(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// Abandon the fetches in progress and skip the rest of the queue
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+/*
+* Function: MetadataQueue.work
+*
+* Parameters: None
+*
+* Returns: None
+*
+* Description: Fetches and stores metadata for links from the queue until it is stopped. Failures are logged and
+*              the link is left without metadata
+ */
+func (q *MetadataQueue) work() {
+	defer q.workers.Done()
+
+	for linkId := range q.jobs {
+		if q.ctx.Err() != nil {
+			continue
+		}
+
+		link, err := GetLink(q.db, linkId)
+		if err != nil {
+			// The link was deleted before its turn came
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+		meta, err := q.fetcher.Fetch(ctx, link.Url)
+		cancel()
+		if err != nil {
+			q.logger.Infof("Could not fetch metadata for link id %d: %s", linkId, err.Error())
+			continue
+		}
+
+		err = SetLinkMetadata(q.db, linkId, meta.Title, meta.Description, meta.FaviconURL)
+		if err != nil {
+			q.logger.Errorf("Could not store metadata for link id %d: %s", linkId, err.Error())
+		}
+	}
+}
@@ -0,0 +1,284 @@
+/*
+* File: cmd/qr.go
+*
+* Description: This file contains the handler that serves QR codes of short links as PNG or SVG images, along with
+*              the in-memory cache of the images that have already been generated
+*
+ */
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+	"github.com/vtallen/go-link-shortener/pkg/codegen"
+	"github.com/vtallen/go-link-shortener/pkg/qrcode"
+)
+
+// The limits and defaults of the query parameters of /:shortcode/qr
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+	defaultMargin = 4
+	maxQRMargin   = 16
+	qrCacheSize   = 256 // The number of generated images kept in memory
+)
+
+// Images that have already been generated, shared by every request
+var generatedQRCodes = newQRCache(qrCacheSize)
+
+/*
+* Struct: qrImage
+*
+* Description: A generated QR code image ready to be sent to the client
+ */
+type qrImage struct {
+	Key         string // The cache key the image was generated for
+	ContentType string // The MIME type of the image
+	ETag        string // A quoted hash of the image used for conditional requests
+	Data        []byte // The encoded image
+}
+
+/*
+* Struct: qrCache
+*
+* Description: A fixed size cache of generated images that evicts the least recently used image when full
+ */
+type qrCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List               // Most recently used at the front, each element holds a *qrImage
+	entries  map[string]*list.Element // Elements of order by cache key
+}
+
+/*
+* Function: newQRCache
+*
+* Parameters: capacity int - The maximum number of images to keep
+*
+* Returns: *qrCache - An empty cache
+*
+* Description: Creates a cache of generated QR code images
+ */
+func newQRCache(capacity int) *qrCache {
+	return &qrCache{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+/*
+* Function: qrCache.Get
+*
+* Parameters: key string - The cache key of the image
+*
+* Returns: *qrImage - The cached image, nil if it is not in the cache
+*
+* Description: Looks up an image, marking it as recently used
+ */
+func (q *qrCache) Get(key string) *qrImage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	element, ok := q.entries[key]
+	if !ok {
+		return nil
+	}
+	q.order.MoveToFront(element)
+	return element.Value.(*qrImage)
+}
+
+/*
+* Function: qrCache.Add
+*
+* Parameters: image *qrImage - The image to store under its key
+*
+* Returns: None
+*
+* Description: Stores an image, evicting the least recently used image if the cache is full
+ */
+func (q *qrCache) Add(image *qrImage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if element, ok := q.entries[image.Key]; ok {
+		element.Value = image
+		q.order.MoveToFront(element)
+		return
+	}
+
+	q.entries[image.Key] = q.order.PushFront(image)
+	if q.order.Len() > q.capacity {
+		oldest := q.order.Back()
+		q.order.Remove(oldest)
+		delete(q.entries, oldest.Value.(*qrImage).Key)
+	}
+}
+
+/*
+* Function: HandleQRCode
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error generating or sending the image
+*
+* Description: Handles a GET request to /:shortcode/qr, sending a QR code of the short url. The optional query
+*              parameters are size (the width in pixels), margin (the quiet zone in modules), ecc (the error
+*              correction level L, M, Q or H), format (png or svg) and domain (the domain of the link, for
+*              downloading a QR code of a link on another domain from the same origin). PNG images use a whole
+*              number of pixels per module, so they are rounded down from size, or up to one pixel per module for
+*              very long urls
+*
+ */
+func HandleQRCode(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	size, err := qrIntParam(c, "size", defaultQRSize, minQRSize, maxQRSize)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "size must be a number from 64 to 2048")
+	}
+
+	margin, err := qrIntParam(c, "margin", defaultMargin, 0, maxQRMargin)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "margin must be a number from 0 to 16")
+	}
+
+	eccParam := strings.ToUpper(c.QueryParam("ecc"))
+	if eccParam == "" {
+		eccParam = "M"
+	}
+	level, err := qrcode.ParseLevel(eccParam)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "ecc must be one of L, M, Q or H")
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		return c.String(http.StatusBadRequest, "format must be png or svg")
+	}
+
+	domain := requestDomain(c, config)
+	if c.QueryParams().Has("domain") {
+		domain, err = formDomain(config, c.QueryParam("domain"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "domain must be the server's host or one of its domains")
+		}
+	}
+
+	shortcode := codegen.NormalizeCase(c.Param("shortcode"), config.Shortcodes.Universe)
+	link, err := GetLinkByShortcode(db, domain, shortcode)
+	if err != nil {
+		errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+		return c.Render(http.StatusNotFound, "error-page", errData)
+	}
+
+	content := ShortURL(config, link.Domain, link.Shortcode)
+	key := content + "|" + strconv.Itoa(size) + "|" + strconv.Itoa(margin) + "|" + eccParam + "|" + format
+
+	image := generatedQRCodes.Get(key)
+	if image == nil {
+		image, err = renderQRCode(key, content, size, margin, level, format)
+		if err != nil {
+			c.Logger().Errorf("Could not generate QR code for %s: %s", content, err.Error())
+			return c.String(http.StatusInternalServerError, "Internal server error")
+		}
+		generatedQRCodes.Add(image)
+	}
+
+	c.Response().Header().Set("ETag", image.ETag)
+	c.Response().Header().Set("Cache-Control", "public, max-age=86400")
+	if c.Request().Header.Get("If-None-Match") == image.ETag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.Blob(http.StatusOK, image.ContentType, image.Data)
+}
+
+/*
+* Function: renderQRCode
+*
+* Parameters: key     string       - The cache key of the image
+*             content string       - The text to encode
+*             size    int          - The width of the image in pixels
+*             margin  int          - The width of the quiet zone in modules
+*             level   qrcode.Level - The error correction level
+*             format  string       - png or svg
+*
+* Returns: *qrImage - The generated image
+*          error    - Any error that occurred while encoding the image
+*
+* Description: Encodes content as a QR code and draws it in the requested format
+ */
+func renderQRCode(key, content string, size, margin int, level qrcode.Level, format string) (*qrImage, error) {
+	code, err := qrcode.Encode([]byte(content), level)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	image := qrImage{Key: key}
+	if format == "svg" {
+		image.ContentType = "image/svg+xml"
+		err = code.WriteSVG(&buf, size, margin)
+	} else {
+		image.ContentType = "image/png"
+		err = code.WritePNG(&buf, size/(code.Size+2*margin), margin)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	image.ETag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	image.Data = buf.Bytes()
+
+	return &image, nil
+}
+
+/*
+* Function: qrIntParam
+*
+* Parameters: c        echo.Context - The context of the request
+*             name     string       - The name of the query parameter
+*             fallback int          - The value used when the parameter is not given
+*             low      int          - The smallest allowed value
+*             high     int          - The largest allowed value
+*
+* Returns: int   - The value of the parameter
+*          error - If the parameter is not a number or is out of range
+*
+* Description: Reads an optional whole number query parameter
+ */
+func qrIntParam(c echo.Context, name string, fallback, low, high int) (int, error) {
+	raw := c.QueryParam(name)
+	if raw == "" {
+		return fallback, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, err
+	}
+	if value < low || value > high {
+		return 0, strconv.ErrRange
+	}
+
+	return value, nil
+}
@@ -0,0 +1,456 @@
+/*
+* File: cmd/redirect.go
+*
+* Description: This file contains how the destination of a link is chosen for a visitor once they are allowed to
+*              follow it. Links can have rules that send visitors on some platforms, speaking some languages or
+*              from some countries elsewhere, and variants that split the remaining visitors between several
+*              destinations. Visitors decided by neither go to the link's own url
+*
+ */
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+	"github.com/vtallen/go-link-shortener/internal/globalstructs"
+	"github.com/vtallen/go-link-shortener/pkg/geoip"
+	"github.com/vtallen/go-link-shortener/pkg/urlutil"
+	"github.com/vtallen/go-link-shortener/pkg/useragent"
+)
+
+// What a rule can match on
+const (
+	ruleKindPlatform = "platform"
+	ruleKindLanguage = "language"
+	ruleKindCountry  = "country"
+)
+
+// What can be done with the query string of a short link, anything else drops it
+const (
+	passthroughMerge    = "merge"
+	passthroughOverride = "override"
+)
+
+// The number of rules and variants a single link can have
+const (
+	maxLinkRules    = 20
+	maxLinkVariants = 10
+)
+
+// The highest weight a variant can have
+const maxVariantWeight = 1000
+
+// How long a visitor keeps their variant of a sticky link
+const stickyVariantDays = 30
+
+// Language tags such as "de", "pt-br" or "zh-hant-tw", lowercased
+var languageTagPattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{1,8})*$`)
+
+/*
+* Struct: visitor
+*
+* Description: What rules are matched against, worked out once per request
+ */
+type visitor struct {
+	platform string // One of the useragent platform constants, empty if unknown
+	language string // The lowercased language tag the visitor prefers most, empty if none was sent
+	country  string // The two letter country code of the visitor's address, empty if unknown
+}
+
+/*
+* Function: followLink
+*
+* Parameters: c      echo.Context        - The context of the request
+*             db     *sql.DB             - A pointer to the database object
+*             config *conf.Config        - The configuration for the application
+*             geo    *geoip.DB           - The GeoIP database, nil if none is configured
+*             link   *globalstructs.Link - The link being followed
+*             status int                 - The redirect status to use for links without rules
+*
+* Returns: error - If there is an error redirecting the user
+*
+* Description: Picks the destination of a link for the visitor, fills it in if it is a template, counts the click
+*              for the link and the rule or variant that decided it, and redirects to it. App links are opened
+*              from the deep link page instead
+ */
+func followLink(c echo.Context, db *sql.DB, config *conf.Config, geo *geoip.DB, link *globalstructs.Link, status int) error {
+	destination := link.Url
+
+	rules, err := GetLinkRules(db, link.ID)
+	if err != nil {
+		// The visitor still gets to the link's own url
+		c.Logger().Errorf("Could not get the rules of link id %d: %s", link.ID, err.Error())
+	}
+
+	var rule *globalstructs.LinkRule
+	if len(rules) > 0 {
+		rule = matchRule(rules, newVisitor(c, geo))
+		if rule != nil {
+			destination = rule.Url
+		}
+	}
+
+	// Visitors that no rule sent elsewhere are split between the variants
+	var variants []globalstructs.LinkVariant
+	var variant *globalstructs.LinkVariant
+	if rule == nil {
+		variants, err = GetLinkVariants(db, link.ID)
+		if err != nil {
+			c.Logger().Errorf("Could not get the variants of link id %d: %s", link.ID, err.Error())
+		}
+
+		variant = pickVariant(c, link, variants)
+		if variant != nil {
+			destination = variant.Url
+		}
+	}
+
+	// Template links are filled in from the rest of the path and the query string, prefix links add the rest of
+	// the path to whichever destination was picked
+	query := c.QueryParams()
+	if urlutil.IsTemplate(destination) {
+		segments, err := pathSegments(c)
+		if err != nil || len(segments) > urlutil.Positionals(destination) {
+			errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+			return c.Render(http.StatusNotFound, "error-page", errData)
+		}
+
+		destination, query, err = urlutil.ExpandTemplate(destination, segments, query)
+		var missing *urlutil.MissingValueError
+		if errors.As(err, &missing) {
+			errData := globalstructs.ErrorPageData{ErrorText: "400, this link needs a value for " + missing.Placeholder}
+			return c.Render(http.StatusBadRequest, "error-page", errData)
+		} else if err != nil {
+			errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+			return c.Render(http.StatusNotFound, "error-page", errData)
+		}
+	} else if link.PrefixMode {
+		destination, err = urlutil.JoinPath(destination, pathSuffix(c))
+		if err != nil {
+			errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+			return c.Render(http.StatusNotFound, "error-page", errData)
+		}
+	}
+
+	// The query string of the short link is passed on to whichever destination was picked
+	destination = passQueryThrough(link.PassthroughMode, destination, query)
+
+	// Browsers cache permanent redirects, which would keep sending a visitor to the first destination they got
+	if (len(rules) > 0 || len(variants) > 0 || urlutil.IsTemplate(link.Url)) && status == http.StatusMovedPermanently {
+		status = http.StatusFound
+	}
+
+	// The allowed schemes may have changed since the link was made, app links that are no longer allowed are
+	// treated as missing
+	parsed, err := url.Parse(destination)
+	deepLink := err == nil && !isWebScheme(strings.ToLower(parsed.Scheme))
+	if deepLink && validateDestination(config, destination) != nil {
+		errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+		return c.Render(http.StatusNotFound, "error-page", errData)
+	}
+
+	if rule != nil {
+		err = IncrementLinkRuleClickCount(db, rule.ID)
+		if err != nil {
+			c.Logger().Errorf("Could not increment click count for rule id: %d", rule.ID)
+		}
+	}
+	if variant != nil {
+		err = IncrementLinkVariantClickCount(db, variant.ID)
+		if err != nil {
+			c.Logger().Errorf("Could not increment click count for variant id: %d", variant.ID)
+		}
+	}
+
+	err = IncrementLinkClickCount(db, link.ID)
+	if err != nil {
+		c.Logger().Errorf("Could not increment click count for link id: %d", link.ID)
+	}
+
+	// Browsers do not follow redirects to most custom schemes, so app links are opened from a page instead
+	if deepLink {
+		return renderDeepLink(c, config, link, destination)
+	}
+
+	return c.Redirect(status, destination)
+}
+
+/*
+* Function: pickVariant
+*
+* Parameters: c        echo.Context                - The context of the request
+*             link     *globalstructs.Link         - The link being followed
+*             variants []globalstructs.LinkVariant - The variants of the link
+*
+* Returns: *globalstructs.LinkVariant - The variant to send the visitor to, nil if the link has none with a weight
+*
+* Description: Picks a variant at random in proportion to the weights. For sticky links the variant is stored in
+*              a cookie and returning visitors get the same one for as long as it is not paused or deleted
+ */
+func pickVariant(c echo.Context, link *globalstructs.Link, variants []globalstructs.LinkVariant) *globalstructs.LinkVariant {
+	cookieName := "variant-" + strconv.Itoa(link.ID)
+
+	if link.StickyVariants {
+		cookie, err := c.Cookie(cookieName)
+		if err == nil {
+			for i := range variants {
+				if strconv.Itoa(variants[i].ID) == cookie.Value && variants[i].Weight > 0 {
+					return &variants[i]
+				}
+			}
+		}
+	}
+
+	total := 0
+	for _, variant := range variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	var picked *globalstructs.LinkVariant
+	n := rand.IntN(total)
+	for i := range variants {
+		n -= variants[i].Weight
+		if n < 0 {
+			picked = &variants[i]
+			break
+		}
+	}
+
+	if link.StickyVariants {
+		c.SetCookie(&http.Cookie{
+			Name:     cookieName,
+			Value:    strconv.Itoa(picked.ID),
+			Path:     "/",
+			MaxAge:   stickyVariantDays * 24 * 60 * 60,
+			Secure:   isHTTPS(c),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return picked
+}
+
+/*
+* Function: pathSuffix
+*
+* Parameters: c echo.Context - The context of the request
+*
+* Returns: string - The escaped path after the shortcode, such as "/api/v2" for /docs/api/v2, empty if there is
+*                   none
+*
+* Description: Reads the path that prefix links forward from the request url rather than the route parameter, so
+*              that it keeps the escaping the visitor used
+ */
+func pathSuffix(c echo.Context) string {
+	path := c.Request().URL.EscapedPath()
+	slash := strings.Index(strings.TrimPrefix(path, "/"), "/")
+	if slash == -1 {
+		return ""
+	}
+	return path[slash+1:]
+}
+
+/*
+* Function: acceptsPath
+*
+* Parameters: link *globalstructs.Link - The link being visited
+*
+* Returns: bool - true if the link can be followed by a path, /:shortcode/*
+*
+* Description: Prefix links forward the path and template links read their values from it. Only the main
+*              destination decides whether a link is a template
+ */
+func acceptsPath(link *globalstructs.Link) bool {
+	return link.PrefixMode || urlutil.IsTemplate(link.Url)
+}
+
+/*
+* Function: pathSegments
+*
+* Parameters: c echo.Context - The context of the request
+*
+* Returns: []string - The unescaped segments of the path after the shortcode, /jira/PROJ-1 gives ["PROJ-1"]
+*          error    - If a segment is not escaped correctly
+*
+* Description: Reads the values of the positional placeholders of a template link. A trailing slash does not add
+*              an empty value
+ */
+func pathSegments(c echo.Context) ([]string, error) {
+	suffix := strings.TrimSuffix(strings.TrimPrefix(pathSuffix(c), "/"), "/")
+	if suffix == "" {
+		return nil, nil
+	}
+
+	segments := strings.Split(suffix, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = unescaped
+	}
+
+	return segments, nil
+}
+
+/*
+* Function: passQueryThrough
+*
+* Parameters: mode        string     - The passthrough mode of the link
+*             destination string     - The url the visitor is being sent to
+*             query       url.Values - The query parameters of the short link
+*
+* Returns: string - The destination with the parameters added
+*
+* Description: In "merge" mode parameters the destination already has are kept, in "override" mode the
+*              visitor's values replace them. Any other mode drops the query string
+ */
+func passQueryThrough(mode string, destination string, query url.Values) string {
+	switch mode {
+	case passthroughMerge:
+		return urlutil.MergeQuery(destination, query, false)
+	case passthroughOverride:
+		return urlutil.MergeQuery(destination, query, true)
+	default:
+		return destination
+	}
+}
+
+/*
+* Function: newVisitor
+*
+* Parameters: c   echo.Context - The context of the request
+*             geo *geoip.DB    - The GeoIP database, nil if none is configured
+*
+* Returns: visitor - The platform, language and country of the request
+*
+* Description: Reads what rules match on from the request
+ */
+func newVisitor(c echo.Context, geo *geoip.DB) visitor {
+	return visitor{
+		platform: useragent.Platform(c.Request().UserAgent()),
+		language: preferredLanguage(c.Request().Header.Get("Accept-Language")),
+		country:  geo.Country(c.RealIP()),
+	}
+}
+
+/*
+* Function: matchRule
+*
+* Parameters: rules []globalstructs.LinkRule - The rules of a link in the order they are checked
+*             v     visitor                  - The visitor following the link
+*
+* Returns: *globalstructs.LinkRule - The first rule that matches, nil if none do
+*
+* Description: Finds the rule that decides where a visitor goes
+ */
+func matchRule(rules []globalstructs.LinkRule, v visitor) *globalstructs.LinkRule {
+	for i := range rules {
+		rule := &rules[i]
+		switch rule.Kind {
+		case ruleKindPlatform:
+			if v.platform != "" && v.platform == rule.Value {
+				return rule
+			}
+		case ruleKindLanguage:
+			// "de" matches every variety of German, "pt-br" only Brazilian Portuguese
+			if v.language != "" && (v.language == rule.Value || strings.HasPrefix(v.language, rule.Value+"-")) {
+				return rule
+			}
+		case ruleKindCountry:
+			if v.country != "" && v.country == rule.Value {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+/*
+* Function: preferredLanguage
+*
+* Parameters: header string - The Accept-Language header of a request
+*
+* Returns: string - The lowercased language tag with the highest quality, the first one listed on a tie. Empty if
+*                   the header names no language
+*
+* Description: Only the most preferred language is matched so that, for example, an English speaker who also
+*              accepts German is not sent to the German site
+ */
+func preferredLanguage(header string) string {
+	best, bestQuality := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		params = strings.TrimSpace(params)
+		if value, ok := strings.CutPrefix(params, "q="); ok {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		if quality > bestQuality {
+			best, bestQuality = tag, quality
+		}
+	}
+	return best
+}
+
+/*
+* Function: normalizeRuleValue
+*
+* Parameters: kind  string - What the rule matches on
+*             value string - The value as entered by the user
+*
+* Returns: string - The value in the form it is matched in
+*          error  - If the kind is unknown or the value is not valid for it
+*
+* Description: Checks a rule before it is saved
+ */
+func normalizeRuleValue(kind string, value string) (string, error) {
+	value = strings.TrimSpace(value)
+
+	switch kind {
+	case ruleKindPlatform:
+		value = strings.ToLower(value)
+		if !slices.Contains(useragent.Platforms, value) {
+			return "", errors.New("unknown platform")
+		}
+	case ruleKindLanguage:
+		value = strings.ToLower(strings.ReplaceAll(value, "_", "-"))
+		if !languageTagPattern.MatchString(value) {
+			return "", errors.New("language must be a language tag such as de or pt-BR")
+		}
+	case ruleKindCountry:
+		value = strings.ToUpper(value)
+		if len(value) != 2 || value[0] < 'A' || value[0] > 'Z' || value[1] < 'A' || value[1] > 'Z' {
+			return "", errors.New("country must be a two letter code such as US or DE")
+		}
+	default:
+		return "", errors.New("unknown rule type")
+	}
+
+	return value, nil
+}
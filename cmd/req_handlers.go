@@ -10,9 +10,13 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -20,64 +24,358 @@ import (
 	"github.com/vtallen/go-link-shortener/internal/globalstructs"
 	"github.com/vtallen/go-link-shortener/internal/sessmngt"
 	"github.com/vtallen/go-link-shortener/pkg/codegen"
+	"github.com/vtallen/go-link-shortener/pkg/geoip"
+	"github.com/vtallen/go-link-shortener/pkg/urlutil"
+	"github.com/vtallen/go-link-shortener/pkg/useragent"
 )
 
+// The maximum lengths of the optional title and description of a link
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 1000
+)
+
+// The maximum length of each UTM parameter added by the UTM builder
+const maxUtmLength = 200
+
+// The number of links loaded at a time on the user page
+const linksPerPage = 25
+
+/*
+* Function: ShortURL
+*
+* Parameters: config    *conf.Config - The configuration for the application
+*             domain    string       - The domain of the link, empty for the default host
+*             shortcode string       - The shortcode of the link
+*
+* Returns: string - The full url that redirects to the link
+*
+* Description: Builds the public url of a link from its domain or the configured host
+ */
+func ShortURL(config *conf.Config, domain string, shortcode string) string {
+	return "https://" + linkHost(config, domain) + "/" + shortcode
+}
+
+/*
+* Function: ClaimURL
+*
+* Parameters: config *conf.Config - The configuration for the application
+*             domain string       - The domain of the link, empty for the default host
+*             token  string       - The claim token of the link
+*
+* Returns: string - The one-time url for claiming the link into an account
+*
+* Description: Builds the claim url on the same domain as the link, so anonymous creators stay on the brand they
+*              created the link on
+ */
+func ClaimURL(config *conf.Config, domain string, token string) string {
+	return "https://" + linkHost(config, domain) + "/claim?token=" + url.QueryEscape(token)
+}
+
+/*
+* Function: linkHost
+*
+* Parameters: config *conf.Config - The configuration for the application
+*             domain string       - The domain of the link, empty for the default host
+*
+* Returns: string - The hostname the link is served on
+ */
+func linkHost(config *conf.Config, domain string) string {
+	if domain != "" {
+		return domain
+	}
+	return config.Server.Host
+}
+
+/*
+* Function: configuredDomain
+*
+* Parameters: config *conf.Config - The configuration for the application
+*             host   string       - A hostname, without a port
+*
+* Returns: string - The entry of server.domains matching host, empty if host is not one of them
+*
+* Description: Hostnames are matched case-insensitively. The default host and unknown hosts give an empty domain,
+*              which is the namespace of the default host
+ */
+func configuredDomain(config *conf.Config, host string) string {
+	for _, domain := range config.Server.Domains {
+		if strings.EqualFold(domain, host) {
+			return domain
+		}
+	}
+	return ""
+}
+
+/*
+* Function: requestDomain
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: string - The domain shortcodes in the request are looked up in, empty for the default host
+*
+* Description: Reads the domain from the Host header of the request
+ */
+func requestDomain(c echo.Context, config *conf.Config) string {
+	host := c.Request().Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return configuredDomain(config, host)
+}
+
+/*
+* Function: formDomain
+*
+* Parameters: config *conf.Config - The configuration for the application
+*             value  string       - The domain picked in a form, empty or server.host for the default host
+*
+* Returns: string - The domain to create links on, empty for the default host
+*          error  - If value is not the default host or one of server.domains
+*
+* Description: Checks the domain a user asked to create links on
+ */
+func formDomain(config *conf.Config, value string) (string, error) {
+	if value == "" || strings.EqualFold(value, config.Server.Host) {
+		return "", nil
+	}
+
+	domain := configuredDomain(config, value)
+	if domain == "" {
+		return "", errors.New("unknown domain " + value)
+	}
+	return domain, nil
+}
+
 /*
 * Function: HandleRedirect
 *
 * Parameters: c      echo.Context - The context of the request
 *            config *conf.Config - The configuration for the application
+*            geo    *geoip.DB    - The GeoIP database used by country rules, nil if none is configured
 *
 * Returns: error - If there is an error redirecting the user
 *
-* Description: This function handles the redirecting of the user to the correct URL based on the shortcode in the url
+* Description: This function handles the redirecting of the user to the correct URL based on the shortcode in the url.
+*              It also handles /:shortcode/*, where the path after the shortcode is forwarded for prefix links
 *
  */
-func HandleRedirect(c echo.Context, config *conf.Config) error {
+func HandleRedirect(c echo.Context, config *conf.Config, geo *geoip.DB) error {
 	db, ok := c.Get("db").(*sql.DB)
 	if !ok {
 		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
 		return c.String(http.StatusInternalServerError, "Internal server error")
 	}
-	shortcode := c.Param("shortcode")
 
-	// Figure out the id
-	id := codegen.UniverseToBaseTen(shortcode, config.Shortcodes.Universe)
-	// Query the db for the link
-	link, err := GetLink(db, id)
+	// A trailing + asks for the preview page instead of the redirect
+	if shortcode, ok := strings.CutSuffix(c.Param("shortcode"), "+"); ok && pathSuffix(c) == "" {
+		return renderPreview(c, db, config, shortcode)
+	}
+
+	// Shortcodes are matched case-insensitively when the universe only contains one case
+	shortcode := codegen.NormalizeCase(c.Param("shortcode"), config.Shortcodes.Universe)
+
+	// Query the db for the link on the domain that was requested, looking it up by shortcode also finds custom aliases
+	link, err := GetLinkByShortcode(db, requestDomain(c, config), shortcode)
 	if err != nil {
 		errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
 		return c.Render(http.StatusNotFound, "error-page", errData) // Show the not found page if link does not exist
 	}
 
-	// Increment the click counter for the link
-	err = IncrementLinkClickCount(db, id)
+	// Only prefix and template links can be followed by a path
+	if pathSuffix(c) != "" && !acceptsPath(link) {
+		errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+		return c.Render(http.StatusNotFound, "error-page", errData)
+	}
+
+	if link.ExpiresAt != 0 && time.Now().Unix() >= link.ExpiresAt {
+		errData := globalstructs.ErrorPageData{ErrorText: "410, this link has expired"}
+		return c.Render(http.StatusGone, "error-page", errData)
+	}
+
+	// Protected links ask for the password first, the click is counted once it is entered correctly
+	if link.PasswordHash != "" {
+		return renderPasswordPrompt(c, config, link, http.StatusOK, "")
+	}
+
+	// Link preview crawlers are shown the owner's social preview instead of the bare redirect, they are not clicks
+	if hasSocialPreview(link) && useragent.IsPreviewBot(c.Request().UserAgent()) {
+		return renderSocialPreview(c, config, link)
+	}
+
+	// Count the click and send the user to the destination that fits them
+	return followLink(c, db, config, geo, link, http.StatusMovedPermanently)
+}
+
+/*
+* Function: HandlePreview
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: error - If there is an error rendering the page
+*
+* Description: This function handles a GET request to /:shortcode/preview, which shows where a link goes without
+*              following it. /:shortcode+ is handled by HandleRedirect and shows the same page
+*
+ */
+func HandlePreview(c echo.Context, config *conf.Config) error {
+	db, ok := c.Get("db").(*sql.DB)
+	if !ok {
+		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return renderPreview(c, db, config, c.Param("shortcode"))
+}
+
+/*
+* Function: renderPreview
+*
+* Parameters: c         echo.Context - The context of the request
+*             db        *sql.DB      - A pointer to the database object
+*             config    *conf.Config - The configuration for the application
+*             shortcode string       - The shortcode of the link, as given in the url
+*
+* Returns: error - If there is an error rendering the page
+*
+* Description: Renders the preview page of a link. Previews do not count as clicks
+ */
+func renderPreview(c echo.Context, db *sql.DB, config *conf.Config, shortcode string) error {
+	shortcode = codegen.NormalizeCase(shortcode, config.Shortcodes.Universe)
+
+	link, err := GetLinkByShortcode(db, requestDomain(c, config), shortcode)
 	if err != nil {
-		c.Logger().Errorf("Could not increment click count for link id: %d", id)
+		errData := globalstructs.ErrorPageData{ErrorText: "404, link does not exist"}
+		return c.Render(http.StatusNotFound, "error-page", errData)
+	}
+
+	data := globalstructs.PreviewPageData{
+		Link:        *link,
+		ShortURL:    ShortURL(config, link.Domain, link.Shortcode),
+		IsExpired:   link.ExpiresAt != 0 && time.Now().Unix() >= link.ExpiresAt,
+		IsProtected: link.PasswordHash != "",
+		IsLoggedIn:  sessmngt.ValidateSession(c) == nil,
+	}
+
+	// The destination of a protected link is only revealed to visitors who know the password
+	if data.IsProtected {
+		data.Link.Url = ""
+		data.Link.PasswordHash = ""
+	} else {
+		data.Rules, err = GetLinkRules(db, link.ID)
+		if err != nil {
+			c.Logger().Errorf("Could not get the rules of link id %d: %s", link.ID, err.Error())
+		}
+		data.Link.Variants, err = GetLinkVariants(db, link.ID)
+		if err != nil {
+			c.Logger().Errorf("Could not get the variants of link id %d: %s", link.ID, err.Error())
+		}
+	}
+
+	return c.Render(http.StatusOK, "preview", data)
+}
+
+/*
+* Function: hasSocialPreview
+*
+* Parameters: link *globalstructs.Link - The link being visited
+*
+* Returns: bool - true if the owner has set any of the social preview fields
+*
+* Description: Links without a social preview redirect crawlers as well, so they see the destination's own preview
+ */
+func hasSocialPreview(link *globalstructs.Link) bool {
+	return link.OgTitle != "" || link.OgDescription != "" || link.OgImage != ""
+}
+
+/*
+* Function: renderSocialPreview
+*
+* Parameters: c      echo.Context        - The context of the request
+*             config *conf.Config        - The configuration for the application
+*             link   *globalstructs.Link - The link being visited
+*
+* Returns: error - If there is an error rendering the page
+*
+* Description: Renders a page with the link's OpenGraph tags and a meta refresh to the destination. Fields the
+*              owner left empty fall back to the link's title and description
+ */
+func renderSocialPreview(c echo.Context, config *conf.Config, link *globalstructs.Link) error {
+	data := globalstructs.SocialPreviewData{
+		Title:       firstNonEmpty(link.OgTitle, link.Title, link.MetaTitle),
+		Description: firstNonEmpty(link.OgDescription, link.Description, link.MetaDescription),
+		Image:       link.OgImage,
+		ShortURL:    ShortURL(config, link.Domain, link.Shortcode),
+		Url:         link.Url,
 	}
 
-	return c.Redirect(http.StatusMovedPermanently, link.Url) // If a url exists, redirect the user to it
+	return c.Render(http.StatusOK, "social-preview", data)
+}
+
+/*
+* Function: firstNonEmpty
+*
+* Parameters: values ...string - Candidate values in order of preference
+*
+* Returns: string - The first value that is not empty
+*
+* Description: Picks the preferred value that is present
+ */
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+/*
+* Function: newIndexData
+*
+* Parameters: c      echo.Context - The context of the request
+*             config *conf.Config - The configuration for the application
+*
+* Returns: *globalstructs.IndexData - An empty create form for the visitor making the request
+*
+* Description: Builds the data for the index and about pages. Each request gets its own, as the create form can
+*              hold an anonymous creator's claim url
+*
+ */
+func newIndexData(c echo.Context, config *conf.Config) *globalstructs.IndexData {
+	return &globalstructs.IndexData{
+		Server:          &config.Server,
+		HCaptchaSiteKey: config.HCaptcha.SiteKey,
+		MetadataEnabled: config.Metadata.Enabled,
+		// The navbar changes based on if a user is logged in or not, this enables the functionality
+		IsLoggedIn: sessmngt.ValidateSession(c) == nil,
+	}
 }
 
 /*
 * Function: HandleAddLink
 *
-* Parameters: c      echo.Context             - The context of the request
-*             config *conf.Config             - The configuration for the application
-*             data   *globalstructs.IndexData - The data to pass to the template
+* Parameters: c        echo.Context   - The context of the request
+*             config   *conf.Config   - The configuration for the application
+*             metadata *MetadataQueue - The queue for fetching the destination's title and description
 *
 * Returns: error - If there is an error adding the link to the database
 *
 * Description: This function handles the adding of a link to the database from a POST request to /create
 *
  */
-func HandleAddLink(c echo.Context, config *conf.Config, data *globalstructs.IndexData) error {
+func HandleAddLink(c echo.Context, config *conf.Config, metadata *MetadataQueue) error {
 	db, ok := c.Get("db").(*sql.DB)
 	if !ok {
 		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB")
 		return c.String(http.StatusInternalServerError, "Internal server error")
 	}
 
+	// Links are only owned by, and deduplicated for, the user making this request
+	data := newIndexData(c, config)
+
 	URL := c.FormValue("url")
 	if URL != "" {
 		// Check the captcha if the user is not logged in
@@ -90,21 +388,55 @@ func HandleAddLink(c echo.Context, config *conf.Config, data *globalstructs.Inde
 			}
 		}
 
-		// Validate the URL
-		_, err := url.Parse(URL)
+		// Validate the URL, template links are checked now so a bad placeholder is not found by the first visitor
+		err := validateDestination(config, URL)
+		if err != nil {
+			data.ShortcodeForm.URL = URL
+			data.ShortcodeForm.HasError = true
+			data.ShortcodeForm.ErrorText = "Invalid URL: " + err.Error()
+			return c.Render(http.StatusOK, "shortcode-form", data)
+		}
+
+		// The optional fields are kept so the form can be filled back in if there is an error
+		data.ShortcodeForm.Title = strings.TrimSpace(c.FormValue("title"))
+		data.ShortcodeForm.Description = strings.TrimSpace(c.FormValue("description"))
+		data.ShortcodeForm.Tags = c.FormValue("tags")
+		if len(data.ShortcodeForm.Title) > maxTitleLength || len(data.ShortcodeForm.Description) > maxDescriptionLength {
+			data.ShortcodeForm.URL = URL
+			data.ShortcodeForm.HasError = true
+			data.ShortcodeForm.ErrorText = "The title or description is too long"
+			return c.Render(http.StatusOK, "shortcode-form", data)
+		}
+
+		// Links are created on the default host unless another of the configured domains was picked
+		data.ShortcodeForm.Domain, err = formDomain(config, c.FormValue("domain"))
 		if err != nil {
 			data.ShortcodeForm.URL = URL
 			data.ShortcodeForm.HasError = true
-			data.ShortcodeForm.ErrorText = "There was an error submitting the URL, please try again"
+			data.ShortcodeForm.ErrorText = "Unknown domain"
 			return c.Render(http.StatusOK, "shortcode-form", data)
 		}
 
-		// Generate a random id for the table
-		id := codegen.GenRandID(config.Shortcodes.Universe, config.Shortcodes.ShortcodeLength)
-		// Create a shortcode from the id
-		shortcode := codegen.BaseTenToUniverse(id, config.Shortcodes.Universe)
+		// The UTM builder and passthrough are part of the same optional fields
+		data.ShortcodeForm.UtmSource = strings.TrimSpace(c.FormValue("utm-source"))
+		data.ShortcodeForm.UtmMedium = strings.TrimSpace(c.FormValue("utm-medium"))
+		data.ShortcodeForm.UtmCampaign = strings.TrimSpace(c.FormValue("utm-campaign"))
+		data.ShortcodeForm.Passthrough = c.FormValue("passthrough")
+		if len(data.ShortcodeForm.UtmSource) > maxUtmLength || len(data.ShortcodeForm.UtmMedium) > maxUtmLength || len(data.ShortcodeForm.UtmCampaign) > maxUtmLength {
+			data.ShortcodeForm.URL = URL
+			data.ShortcodeForm.HasError = true
+			data.ShortcodeForm.ErrorText = "The UTM parameters are too long"
+			return c.Render(http.StatusOK, "shortcode-form", data)
+		}
+		if !isPassthroughMode(data.ShortcodeForm.Passthrough) {
+			data.ShortcodeForm.URL = URL
+			data.ShortcodeForm.HasError = true
+			data.ShortcodeForm.ErrorText = "Unknown query string option"
+			return c.Render(http.StatusOK, "shortcode-form", data)
+		}
 
-		// Put the link in the database, tag it with the user ID if the user is logged in
+		// Links created by users that are not logged in are tagged with the user ID -1
+		userId := -1
 		if data.IsLoggedIn {
 			sess, err := session.Get("session", c)
 			if err != nil {
@@ -112,29 +444,94 @@ func HandleAddLink(c echo.Context, config *conf.Config, data *globalstructs.Inde
 				data.ShortcodeForm.ErrorText = "Could not get the session"
 				return c.Render(http.StatusOK, "shortcode-form", data)
 			}
-			userId, ok := sess.Values["userId"].(int)
+			userId, ok = sess.Values["userId"].(int)
 			if !ok {
 				data.ShortcodeForm.HasError = true
 				data.ShortcodeForm.ErrorText = "Internal Server Error"
 				return c.Render(http.StatusOK, "shortcode-form", data)
 			}
-			err = AddLink(db, id, shortcode, URL, userId)
-			if err != nil {
-				c.Logger().Errorf("Could not add link to database: %s", err.Error())
-				return c.String(http.StatusInternalServerError, "Error adding link to database")
+		}
+
+		// The UTM parameters become part of the destination, so links to the same page with different
+		// parameters are different links
+		if userId != -1 {
+			URL = urlutil.MergeQuery(URL, utmParams(&data.ShortcodeForm), true)
+		}
+
+		// Give the user back the link they already have for this URL unless they asked for a new one
+		if userId != -1 && c.FormValue("always-new") != "on" {
+			existing, err := GetUserLinkByURL(db, userId, data.ShortcodeForm.Domain, URL)
+			if err == nil {
+				data.ShortcodeForm.Result = existing.Shortcode
+				data.ShortcodeForm.ResultURL = ShortURL(config, existing.Domain, existing.Shortcode)
+				data.ShortcodeForm.IsExisting = true
+				data.ShortcodeForm.ClaimURL = ""
+				data.ShortcodeForm.URL = ""
+				data.ShortcodeForm.Title = ""
+				data.ShortcodeForm.Description = ""
+				data.ShortcodeForm.Tags = ""
+				resetUtmFields(&data.ShortcodeForm)
+				data.ShortcodeForm.HasError = false
+				return c.Render(http.StatusOK, "shortcode-form", data)
+			} else if err != sql.ErrNoRows {
+				c.Logger().Errorf("Could not look up existing links for user id %d: %s", userId, err.Error())
+			}
+		}
+
+		// Generate a random id for the table along with the shortcode that represents it
+		id, shortcode, err := GenUniqueID(db, &config.Shortcodes)
+		if err != nil {
+			c.Logger().Errorf("Could not generate a shortcode: %s", err.Error())
+			data.ShortcodeForm.HasError = true
+			data.ShortcodeForm.ErrorText = "Could not generate a shortcode, please try again"
+			return c.Render(http.StatusOK, "shortcode-form", data)
+		}
+
+		// Put the link in the database, logged in users can also give it a title, description and tags
+		link := globalstructs.Link{ID: id, Shortcode: shortcode, Domain: data.ShortcodeForm.Domain, Url: URL, UserId: userId}
+		if userId != -1 {
+			link.Title = data.ShortcodeForm.Title
+			link.Description = data.ShortcodeForm.Description
+			link.Tags = ParseTags(data.ShortcodeForm.Tags)
+			link.UtmSource = data.ShortcodeForm.UtmSource
+			link.UtmMedium = data.ShortcodeForm.UtmMedium
+			link.UtmCampaign = data.ShortcodeForm.UtmCampaign
+			link.PassthroughMode = data.ShortcodeForm.Passthrough
+		}
+		err = InsertLink(db, &link)
+		if err != nil {
+			c.Logger().Errorf("Could not add link to database: %s", err.Error())
+			return c.String(http.StatusInternalServerError, "Error adding link to database")
+		}
+
+		// The title and description of the destination are fetched in the background if the user asked for them,
+		// templates are not a page that can be fetched
+		if userId != -1 && c.FormValue("fetch-metadata") == "on" && !urlutil.IsTemplate(URL) {
+			if !metadata.Enqueue(link.ID) {
+				c.Logger().Warnf("Could not queue a metadata fetch for link id %d", link.ID)
 			}
+		}
 
-		} else {
-			err = AddLink(db, id, shortcode, URL, -1)
+		// Anonymous creators are given a one-time link for moving the new link into an account
+		data.ShortcodeForm.ClaimURL = ""
+		if userId == -1 && config.Cleanup.ClaimWindowMinutes > 0 {
+			token, err := NewClaimToken(db, link.ID)
 			if err != nil {
-				c.Logger().Errorf("Could not add link to database: %s", err.Error())
-				return c.String(http.StatusInternalServerError, "Error adding link to database")
+				c.Logger().Errorf("Could not create a claim token for link id %d: %s", link.ID, err.Error())
+			} else {
+				data.ShortcodeForm.ClaimURL = ClaimURL(config, link.Domain, token)
 			}
 		}
 
 		// Set all of the data for the form to be displayed
 		data.ShortcodeForm.Result = shortcode
+		data.ShortcodeForm.ResultURL = ShortURL(config, link.Domain, shortcode)
+		data.ShortcodeForm.IsExisting = false
 		data.ShortcodeForm.URL = ""
+		data.ShortcodeForm.Title = ""
+		data.ShortcodeForm.Description = ""
+		data.ShortcodeForm.Tags = ""
+		resetUtmFields(&data.ShortcodeForm)
 		data.ShortcodeForm.HasError = false
 
 		return c.Render(http.StatusOK, "shortcode-form", data)
@@ -147,6 +544,54 @@ func HandleAddLink(c echo.Context, config *conf.Config, data *globalstructs.Inde
 	return c.Render(http.StatusOK, "shortcode-form", data)
 }
 
+/*
+* Function: utmParams
+*
+* Parameters: form *globalstructs.ShortcodeForm - The submitted create form
+*
+* Returns: url.Values - The UTM parameters that were filled in
+*
+* Description: Builds the query parameters the UTM builder adds to the destination
+ */
+func utmParams(form *globalstructs.ShortcodeForm) url.Values {
+	params := make(url.Values)
+	for key, value := range map[string]string{"utm_source": form.UtmSource, "utm_medium": form.UtmMedium, "utm_campaign": form.UtmCampaign} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	return params
+}
+
+/*
+* Function: resetUtmFields
+*
+* Parameters: form *globalstructs.ShortcodeForm - The create form
+*
+* Returns: None
+*
+* Description: Empties the UTM builder and query string option once a link was created
+ */
+func resetUtmFields(form *globalstructs.ShortcodeForm) {
+	form.UtmSource = ""
+	form.UtmMedium = ""
+	form.UtmCampaign = ""
+	form.Passthrough = ""
+}
+
+/*
+* Function: isPassthroughMode
+*
+* Parameters: mode string - The query string option as submitted
+*
+* Returns: bool - true if mode is empty, "merge" or "override"
+*
+* Description: Checks the query string option of a link before it is saved
+ */
+func isPassthroughMode(mode string) bool {
+	return mode == "" || mode == passthroughMerge || mode == passthroughOverride
+}
+
 /*
 * Function: HandleDeleteLink
 *
@@ -194,35 +639,109 @@ func HandleDeleteLink(c echo.Context) error {
 *
  */
 func HandleUserPage(c echo.Context, data *globalstructs.UserPageData, config *conf.Config) error {
+	err := loadUserLinks(c, data)
+	if err == ErrInvalidCursor {
+		return c.String(http.StatusBadRequest, "Invalid cursor")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return c.Render(http.StatusOK, "user-homepage", data)
+}
+
+/*
+* Function: HandleUserLinkRows
+*
+* Parameters: c    echo.Context                - The context of the request
+*             data *globalstructs.UserPageData - The data to pass to the template
+*
+* Returns: error - If there is an error getting the user links from the database
+*
+* Description: This function handles GET requests to /user/links, which htmx uses to replace only the rows of the
+*              links table when the user searches, filters or sorts, and to add the next page as the user scrolls
+*
+ */
+func HandleUserLinkRows(c echo.Context, data *globalstructs.UserPageData) error {
+	err := loadUserLinks(c, data)
+	if err == ErrInvalidCursor {
+		return c.String(http.StatusBadRequest, "Invalid cursor")
+	} else if err != nil {
+		return c.String(http.StatusInternalServerError, "Internal server error")
+	}
+
+	return c.Render(http.StatusOK, "link-rows", data)
+}
+
+/*
+* Function: loadUserLinks
+*
+* Parameters: c    echo.Context                - The context of the request
+*             data *globalstructs.UserPageData - The data to fill in, owned by this request
+*
+* Returns: error - If there is an error getting the user links from the database, the error is logged
+*
+* Description: Reads the search, tag, sort and cursor query parameters and fills in the matching page of the logged
+*              in user's links along with the values needed to show the filters and load the next page
+*
+ */
+func loadUserLinks(c echo.Context, data *globalstructs.UserPageData) error {
 	db, ok := c.Get("db").(*sql.DB)
 	if !ok {
 		c.Logger().Errorf("Could not get db from context, failed to convert to *sql.DB\n")
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return errors.New("could not get db from context")
 	}
 
 	sess, err := session.Get("session", c)
 	if err != nil {
 		c.Logger().Errorf("Could not get session from context: %s\n", err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return err
 	}
 
 	userId, ok := sess.Values["userId"].(int)
 	if !ok {
 		c.Logger().Errorf("Could not convert the session userId to int.\n")
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		return errors.New("could not convert the session userId to int")
 	}
 
-	data.LinksData, err = GetUserLinks(db, userId)
+	data.Query = globalstructs.LinkQuery{
+		Search:  strings.TrimSpace(c.QueryParam("q")),
+		Tag:     c.QueryParam("tag"),
+		Sort:    c.QueryParam("sort"),
+		After:   c.QueryParam("after"),
+		PerPage: linksPerPage,
+	}
+	if _, ok := linkSorts[data.Query.Sort]; !ok {
+		data.Query.Sort = "created"
+	}
+
+	data.LinksData, data.TotalLinks, data.NextCursor, err = SearchUserLinks(db, userId, data.Query)
 	if err != nil {
-		c.Logger().Error("Could not get user links from database. Error:%s\n ", err.Error())
-		return c.String(http.StatusInternalServerError, "Internal server error")
+		c.Logger().Errorf("Could not get user links from database. Error:%s\n ", err.Error())
+		return err
 	}
 
-	if len(data.LinksData) == 0 {
-		data.LinksDataEmpty = true
-	} else {
-		data.LinksDataEmpty = false
+	// The clicks of each variant are shown next to the link's total
+	linkIds := make([]int, len(data.LinksData))
+	for i, link := range data.LinksData {
+		linkIds[i] = link.ID
+	}
+	variants, err := GetVariantsForLinks(db, linkIds)
+	if err != nil {
+		c.Logger().Errorf("Could not get link variants from database. Error:%s\n ", err.Error())
+		return err
+	}
+	for i := range data.LinksData {
+		data.LinksData[i].Variants = variants[data.LinksData[i].ID]
 	}
 
-	return c.Render(http.StatusOK, "user-homepage", data)
+	data.Tags, err = GetUserTags(db, userId)
+	if err != nil {
+		c.Logger().Errorf("Could not get user tags from database. Error:%s\n ", err.Error())
+		return err
+	}
+
+	// Only the first page says there are no links, later pages are added below rows that already exist
+	data.LinksDataEmpty = len(data.LinksData) == 0 && data.Query.After == ""
+
+	return nil
 }
@@ -0,0 +1,213 @@
+/*
+* File: cmd/signals.go
+*
+* Description: This file contains how the server reacts to signals. SIGINT and SIGTERM stop it gracefully, letting
+*              requests in progress finish and the background jobs stop before the database is closed. SIGHUP
+*              reloads the configuration file and the templates without dropping any connection
+*
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/vtallen/go-link-shortener/internal/conf"
+)
+
+// How long requests in progress are given to finish when server.shutdown_timeout_seconds is not set
+const defaultShutdownTimeout = 30 * time.Second
+
+/*
+* Function: configMiddleware
+*
+* Parameters: live *atomic.Pointer[conf.Config] - The current configuration, replaced as a whole by a reload
+*
+* Returns: echo.MiddlewareFunc - A middleware function that sets the configuration in the echo context
+*
+* Description: Loads the configuration once per request, so a request sees either the old or the new
+*              configuration and never a mix. A reload never waits for requests, however slow they are. Must be
+*              registered before any middleware that reads the configuration with requestConfig
+ */
+func configMiddleware(live *atomic.Pointer[conf.Config]) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("config", live.Load())
+			return next(c)
+		}
+	}
+}
+
+/*
+* Function: requestConfig
+*
+* Parameters: c echo.Context - The context of the request
+*
+* Returns: *conf.Config - The configuration the request was started with, it must not be modified
+*
+* Description: Reads what configMiddleware set. Every route is behind configMiddleware, so a missing configuration
+*              is a programming error and panics
+ */
+func requestConfig(c echo.Context) *conf.Config {
+	return c.Get("config").(*conf.Config)
+}
+
+/*
+* Function: applyReloadedConfig
+*
+* Parameters: current   *conf.Config - The configuration in use, not modified
+*             newConfig *conf.Config - The configuration read from the file again
+*
+* Returns: *conf.Config - A copy of current with the settings that are read on every request taken from newConfig
+*          bool         - true if the file also changed settings that only take effect after a restart
+*
+* Description: Listeners, certificates, the database, the cookie store, the domains and the background jobs are set
+*              up once at startup and keep their values
+ */
+func applyReloadedConfig(current *conf.Config, newConfig *conf.Config) (*conf.Config, bool) {
+	config := *current
+	config.Shortcodes = newConfig.Shortcodes
+	config.HCaptcha = newConfig.HCaptcha
+	config.DeepLinks = newConfig.DeepLinks
+	config.Server.HSTSMaxAge = newConfig.Server.HSTSMaxAge
+	config.Auth.CookieMaxAgeDays = newConfig.Auth.CookieMaxAgeDays
+	config.Cleanup.ClaimWindowMinutes = newConfig.Cleanup.ClaimWindowMinutes
+	config.Logging.LogLevel = newConfig.Logging.LogLevel
+
+	return &config, !reflect.DeepEqual(config, *newConfig)
+}
+
+/*
+* Function: reloadConfig
+*
+* Parameters: e          *echo.Echo                   - The web server, its logger's level is updated
+*             configPath string                       - The path the configuration was loaded from
+*             live       *atomic.Pointer[conf.Config] - The configuration in use
+*             templates  *Templates                   - The html templates in use
+*
+* Returns: None
+*
+* Description: Handles SIGHUP. A configuration file that cannot be loaded is logged and the current configuration
+*              is kept, and the same goes for templates that do not parse. Requests in progress finish with the
+*              configuration they started with
+ */
+func reloadConfig(e *echo.Echo, configPath string, live *atomic.Pointer[conf.Config], templates *Templates) {
+	e.Logger.Infof("Reloading %s and the templates", configPath)
+
+	err := templates.Reload()
+	if err != nil {
+		e.Logger.Errorf("Could not reload the templates, keeping the current ones. Error: %s", err.Error())
+	}
+
+	newConfig, err := conf.LoadConfig(configPath)
+	if err != nil {
+		e.Logger.Errorf("Could not reload %s, keeping the current configuration. Error: %s", configPath, err.Error())
+		return
+	}
+
+	// Only this goroutine stores the configuration, so nothing can change between the load and the store
+	config, restartNeeded := applyReloadedConfig(live.Load(), newConfig)
+	live.Store(config)
+	e.Logger.SetLevel(stringToLogLevel(config.Logging.LogLevel))
+
+	if restartNeeded {
+		e.Logger.Warnf("Some changed settings in %s only take effect after a restart", configPath)
+	}
+}
+
+/*
+* Function: waitForSignals
+*
+* Parameters: e          *echo.Echo                   - The web server
+*             configPath string                       - The path the configuration was loaded from
+*             live       *atomic.Pointer[conf.Config] - The configuration in use
+*             templates  *Templates                   - The html templates in use
+*             serverErr  <-chan error                 - Receives the error the server stopped with
+*
+* Returns: None
+*
+* Description: Blocks until SIGINT or SIGTERM is received, reloading the configuration on every SIGHUP. If the
+*              server stops by itself, such as when its port is in use, the error is logged and the process exits
+ */
+func waitForSignals(e *echo.Echo, configPath string, live *atomic.Pointer[conf.Config], templates *Templates, serverErr <-chan error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop() // A second SIGINT during the shutdown kills the process as usual
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-hangup:
+			reloadConfig(e, configPath, live, templates)
+		case err := <-serverErr:
+			e.Logger.Fatal(err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+* Function: shutdown
+*
+* Parameters: e              *echo.Echo     - The web server
+*             config         *conf.Config   - The configuration the server was started with
+*             redirectServer *http.Server   - The HTTP redirect listener, nil if it is not running
+*             cleanupJob     *CleanupJob    - The cleanup job, nil if it is not running
+*             metadataQueue  *MetadataQueue - The metadata queue, nil if it is not running
+*             db             *sql.DB        - The database, closed last
+*
+* Returns: None
+*
+* Description: Stops accepting connections and waits up to server.shutdown_timeout_seconds for the requests in
+*              progress and the queued metadata fetches. Connections still open after that are closed. The
+*              database is closed once nothing uses it anymore
+ */
+func shutdown(e *echo.Echo, config *conf.Config, redirectServer *http.Server, cleanupJob *CleanupJob, metadataQueue *MetadataQueue, db *sql.DB) {
+	timeout := defaultShutdownTimeout
+	if config.Server.ShutdownTimeoutSeconds > 0 {
+		timeout = time.Duration(config.Server.ShutdownTimeoutSeconds) * time.Second
+	}
+	e.Logger.Infof("Shutting down, waiting up to %s for requests in progress", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if redirectServer != nil {
+		err := redirectServer.Shutdown(ctx)
+		if err != nil {
+			redirectServer.Close()
+		}
+	}
+
+	err := e.Shutdown(ctx)
+	if err != nil {
+		e.Logger.Warnf("Some requests did not finish in time and were dropped. Error: %s", err.Error())
+		e.Close()
+	}
+
+	cleanupJob.Stop()
+
+	err = metadataQueue.Stop(ctx)
+	if err != nil {
+		e.Logger.Warnf("Some links were left without metadata. Error: %s", err.Error())
+	}
+
+	err = db.Close()
+	if err != nil {
+		e.Logger.Errorf("Could not close the database. Error: %s", err.Error())
+	}
+
+	e.Logger.Info("Server stopped")
+}
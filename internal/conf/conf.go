@@ -50,6 +50,11 @@ type Config struct {
 	Logging    Logging
 	Database   Database
 	HCaptcha   HCaptcha
+	Cleanup    Cleanup
+	Metadata   Metadata
+	GeoIP      GeoIP
+	DeepLinks  DeepLinks
+	ACME       ACME
 }
 
 /*
@@ -70,8 +75,16 @@ type HCaptcha struct {
 }
 
 type Server struct {
-	Host string `yaml:"host"` // The host to bind the server to
-	Port int    `yaml:"port"` // The port to bind the server to
+	Host    string   `yaml:"host"`    // The host to bind the server to
+	Port    int      `yaml:"port"`    // The port to bind the server to
+	Domains []string `yaml:"domains"` // Further hostnames, such as go.example.com, that each have their own shortcodes. host is the default
+
+	PlainHTTP      bool     `yaml:"plain_http"`      // Serve plain HTTP on port, for running behind a reverse proxy that terminates TLS
+	RedirectPort   int      `yaml:"redirect_port"`   // A second port, usually 80, that redirects plain HTTP to HTTPS. 0 disables it
+	HSTSMaxAge     int      `yaml:"hsts_max_age"`    // The max-age in seconds of the Strict-Transport-Security header sent over HTTPS, 0 disables it
+	TrustedProxies []string `yaml:"trusted_proxies"` // Addresses or CIDR ranges of reverse proxies whose X-Forwarded-For and X-Forwarded-Proto are believed
+
+	ShutdownTimeoutSeconds int `yaml:"shutdown_timeout_seconds"` // How long requests in progress are given to finish on SIGINT or SIGTERM, defaults to 30
 }
 
 type Database struct {
@@ -79,11 +92,46 @@ type Database struct {
 }
 
 type Shortcodes struct {
-	ShortcodeLength int    `yaml:"shortcode_length"`   // The maximum length of any shortcode generated
-	Universe        string `yaml:"shortcode_universe"` // The characters allowed in generated shortcodes
+	ShortcodeLength    int      `yaml:"shortcode_length"`    // The maximum length of any shortcode generated
+	Universe           string   `yaml:"shortcode_universe"`  // The characters allowed in generated shortcodes
+	ExcludeConfusables bool     `yaml:"exclude_confusables"` // Regenerate shortcodes that contain easily misread characters such as l/1/I or O/0
+	Denylist           []string `yaml:"denylist"`            // Substrings that may never appear in a generated shortcode, checked case-insensitively
 }
 
 type Logging struct {
 	LogLevel string `yaml:"log_level"` // The log level to output to the log, one of INFO, WARN, ERROR, DEBUG
 	LogFile  string `yaml:"log_file"`  // The path of the file to output logging to
 }
+
+type Cleanup struct {
+	IntervalMinutes       int `yaml:"interval_minutes"`        // How often the cleanup job runs, defaults to 60
+	UnusedLinkDays        int `yaml:"unused_link_days"`        // Delete links not created or clicked for this many days, 0 to keep them forever
+	AnonymousMaxAgeDays   int `yaml:"anonymous_max_age_days"`  // Delete links made by logged out users this many days after creation, 0 to keep them
+	AnonymousInactiveDays int `yaml:"anonymous_inactive_days"` // Delete links made by logged out users not clicked for this many days, 0 to keep them
+	ClaimWindowMinutes    int `yaml:"claim_window_minutes"`    // How long after creation a logged out user can claim a link into an account, 0 disables claiming
+}
+
+type Metadata struct {
+	Enabled        bool  `yaml:"enabled"`         // Lets logged in users fetch the title, description and icon of their links' destinations
+	Workers        int   `yaml:"workers"`         // The number of pages fetched at the same time, defaults to 2
+	TimeoutSeconds int   `yaml:"timeout_seconds"` // The maximum time spent fetching one page, defaults to 5
+	MaxBytes       int64 `yaml:"max_bytes"`       // The maximum number of bytes read from one page, defaults to 1 MiB
+	AllowPrivate   bool  `yaml:"allow_private"`   // Allow fetching pages on loopback and private addresses, only enable this on an intranet
+}
+
+type GeoIP struct {
+	Database string `yaml:"database"` // Path to a CSV of address ranges and country codes, country rules never match when empty
+}
+
+type DeepLinks struct {
+	AllowedSchemes  []string `yaml:"allowed_schemes"`   // Schemes other than http and https that links may go to, such as myapp for myapp://product/1
+	FallbackDelayMs int      `yaml:"fallback_delay_ms"` // How long the deep link page waits for the app to open before going to the fallback url, defaults to 1500
+}
+
+type ACME struct {
+	Enabled      bool   `yaml:"enabled"`       // Request certificates for server.host and server.domains instead of using auth.tls_cert and auth.tls_key
+	Email        string `yaml:"email"`         // The contact address given to the certificate authority for expiry notices
+	CacheDir     string `yaml:"cache_dir"`     // Where the account key and certificates are kept between restarts, defaults to ./acme-cache
+	DirectoryURL string `yaml:"directory_url"` // The ACME directory of the certificate authority, defaults to Let's Encrypt
+	CACert       string `yaml:"ca_cert"`       // A PEM root to trust for the directory, for test authorities such as Pebble that use their own
+}
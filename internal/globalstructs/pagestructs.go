@@ -8,6 +8,8 @@
 package globalstructs
 
 import (
+	"html/template"
+
 	"github.com/vtallen/go-link-shortener/internal/conf"
 )
 
@@ -20,6 +22,7 @@ type IndexData struct {
 	ShortcodeForm   ShortcodeForm // Contains information for the re-filling of the form upon unseccessful completion
 	Server          *conf.Server  // Contains config information about the hostname of the server for the generated shortcodes
 	HCaptchaSiteKey string        // Used to enable the use of hCaptcha
+	MetadataEnabled bool          // Shows the option to fetch the title and description of the destination
 
 	IsLoggedIn bool // Used by the navbar to change what appears based on if a user is logged in
 }
@@ -27,14 +30,34 @@ type IndexData struct {
 /*
 * Struct: UserPageData
 *
-* Description: This struct is used to pass data to the user page.
+* Description: This struct is used to pass data to the user page. It holds one user's links and the cursor of their
+*              next page, so a new one is made for every request
 *
  */
 type UserPageData struct {
-	LinksData  []Link // All of the user's links that they have created
+	LinksData  []Link // The page of the user's links that match the current search
 	IsLoggedIn bool   // Used by the navbar to change what appears based on if a user is logged in.
 	// This should always be true for this route as the session middleware is called by route /user
-	LinksDataEmpty bool // Used to determine if the user has any links to display
+	LinksDataEmpty bool         // Used to determine if the user has any links to display
+	Query          LinkQuery    // The search, tag filter, sort order and position currently shown
+	Tags           []string     // Every tag the user has used, offered as filters
+	TotalLinks     int          // The number of links that match the current search, only set for the first page
+	NextCursor     string       // Used to load the page after this one as the user scrolls, empty on the last page
+	Server         *conf.Server // The default host and the other domains links can be created on
+}
+
+/*
+* Struct: LinkQuery
+*
+* Description: Describes which of a user's links to show on the user page
+*
+ */
+type LinkQuery struct {
+	Search  string // Text to look for in the url, shortcode, title, description and tags
+	Tag     string // Only show links with this tag when not empty
+	Sort    string // "created" for newest first, "clicks" for most clicked first or "shortcode" for alphabetical
+	After   string // The cursor of the last link already shown, empty for the first page
+	PerPage int    // The number of links on each page
 }
 
 /*
@@ -45,10 +68,21 @@ type UserPageData struct {
 *
  */
 type ShortcodeForm struct {
-	URL       string // The url that the user wants to shorten
-	Result    string // The result of the shortcode generation
-	HasError  bool   // If the form was submitted with errors
-	ErrorText string // The error text to display if the form was submitted with errors
+	URL         string // The url that the user wants to shorten
+	Title       string // The optional title for the link
+	Description string // The optional description for the link
+	Tags        string // The optional tags for the link, separated by commas
+	UtmSource   string // The optional utm_source to add to the url
+	UtmMedium   string // The optional utm_medium to add to the url
+	UtmCampaign string // The optional utm_campaign to add to the url
+	Passthrough string // What to do with the query string of the short link, "merge", "override" or empty
+	Domain      string // The domain the link is created on, empty for the default host
+	Result      string // The result of the shortcode generation
+	ResultURL   string // The full short url of Result, on the domain it was created on
+	IsExisting  bool   // true if Result is a link the user had already created for the same url
+	ClaimURL    string // For users that are not logged in, the one-time url for claiming Result into an account
+	HasError    bool   // If the form was submitted with errors
+	ErrorText   string // The error text to display if the form was submitted with errors
 }
 
 /*
@@ -120,9 +154,162 @@ type RegisterForm struct {
 * Description: Used to represent a link in the database
  */
 type Link struct {
-	ID        int    // The id of the link in the database
-	Shortcode string // The shortcode used to access this link. Is a base b representation of ID
-	Url       string // The url that the shortcode redirects to
-	UserId    int    // The id of the user that created this link. -1 if the link was created by an unauthenticated user
-	Clicks    int    // The number of times the link has been clicked
+	ID              int      // The id of the link in the database
+	Shortcode       string   // The shortcode used to access this link. Is a base b representation of ID unless it is a custom alias
+	Domain          string   // The domain the shortcode belongs to, empty for the default host in server.host
+	Url             string   // The url that the shortcode redirects to
+	UserId          int      // The id of the user that created this link. -1 if the link was created by an unauthenticated user
+	Clicks          int      // The number of times the link has been clicked
+	Tags            []string // Free-form labels the owner has given the link
+	ExpiresAt       int64    // The unix time after which the link stops redirecting, 0 if it never expires
+	CreatedAt       int64    // The unix time the link was created at, 0 for links created before this was recorded
+	Title           string   // An optional title the owner has given the link
+	Description     string   // An optional description the owner has given the link
+	LastClickedAt   int64    // The unix time of the most recent click, 0 if the link has not been clicked since this was recorded
+	MetaTitle       string   // The title fetched from the destination page
+	MetaDescription string   // The description fetched from the destination page
+	MetaFavicon     string   // The url of the destination page's icon
+	MetaFetchedAt   int64    // The unix time the metadata was fetched, 0 if it never was
+	OgTitle         string   // The title shown in link previews in chat apps and social networks
+	OgDescription   string   // The description shown in link previews
+	OgImage         string   // The url of the image shown in link previews
+	PasswordHash    string   // The bcrypt hash of the password visitors must enter, empty if the link is not protected
+	StickyVariants  bool     // Send returning visitors to the variant they got the first time
+	PassthroughMode string   // What is done with the query string of the short link: "merge", "override" or empty to drop it
+	UtmSource       string   // The utm_source added to the url by the UTM builder
+	UtmMedium       string   // The utm_medium added to the url by the UTM builder
+	UtmCampaign     string   // The utm_campaign added to the url by the UTM builder
+	PrefixMode      bool     // Add any path after the shortcode to the destination, /docs/api goes to Url + "/api"
+	FallbackUrl     string   // Where the deep link page sends visitors whose app did not open, empty to stay on the page
+
+	Variants []LinkVariant // The destinations traffic is split between, only loaded where they are shown
+}
+
+/*
+* Struct: LinkRule
+*
+* Description: Sends the visitors of a link that match a condition to a different destination. The rules of a link
+*              are checked in order and the first match wins, visitors matching none go to the link's own url
+ */
+type LinkRule struct {
+	ID       int    // The id of the rule in the database
+	LinkId   int    // The id of the link the rule belongs to
+	Position int    // The order the rule is checked in, lowest first
+	Kind     string // What the rule matches on, "platform", "language" or "country"
+	Value    string // The platform, language tag or two letter country code to match
+	Url      string // Where matching visitors are sent
+	Clicks   int    // The number of visitors sent to Url by this rule
+}
+
+/*
+* Struct: LinkVariant
+*
+* Description: One of the destinations a link splits its traffic between. Each visitor that no rule matched is
+*              sent to a variant picked at random in proportion to the weights
+ */
+type LinkVariant struct {
+	ID     int    // The id of the variant in the database
+	LinkId int    // The id of the link the variant belongs to
+	Label  string // A letter naming the variant in the order they were added, not stored
+	Url    string // Where visitors given this variant are sent
+	Weight int    // The share of traffic the variant gets relative to the others, 0 pauses it
+	Clicks int    // The number of visitors sent to Url
+}
+
+/*
+* Struct: DailyClicks
+*
+* Description: The number of times a link was clicked on a single day
+ */
+type DailyClicks struct {
+	Day    string `json:"day"`    // The day in UTC, formatted as YYYY-MM-DD
+	Clicks int    `json:"clicks"` // The number of clicks on that day
+}
+
+/*
+* Struct: ClaimPageData
+*
+* Description: This struct is used to pass data to the page where an anonymous link is claimed into an account.
+*
+ */
+type ClaimPageData struct {
+	Token      string // The claim token from the link given to the creator
+	ShortURL   string // The short url of the link being claimed
+	Url        string // The url the link redirects to
+	IsLoggedIn bool   // Used by the navbar and to choose between the claim button and the login links
+}
+
+/*
+* Struct: PreviewPageData
+*
+* Description: This struct is used to pass data to the page that shows where a link goes without following it.
+*
+ */
+type PreviewPageData struct {
+	Link        Link       // The link being previewed
+	ShortURL    string     // The short url of the link
+	IsExpired   bool       // true if the link has expired and no longer redirects
+	IsProtected bool       // true if the link asks for a password, its url and rules are left empty
+	Rules       []LinkRule // The redirect rules of the link, so every destination can be checked
+	IsLoggedIn  bool       // Used by the navbar to change what appears based on if a user is logged in
+}
+
+/*
+* Struct: LinkSettingsData
+*
+* Description: This struct is used to pass data to the settings page of a single link.
+*
+ */
+type LinkSettingsData struct {
+	Link         Link       // The link being edited
+	ShortURL     string     // The short url of the link
+	Rules        []LinkRule // The redirect rules of the link, in the order they are checked
+	Platforms    []string   // The platforms rules can match on
+	GeoIPEnabled bool       // false if no GeoIP database is configured, country rules never match
+	Saved        bool       // true after the settings were saved
+	HasError     bool       // If the form was submitted with errors
+	ErrorText    string     // The error text to display if the form was submitted with errors
+	IsLoggedIn   bool       // Used by the navbar to change what appears based on if a user is logged in
+}
+
+/*
+* Struct: DeepLinkData
+*
+* Description: This struct is used to pass data to the page that opens an app link and falls back to a web page.
+*
+ */
+type DeepLinkData struct {
+	DeepLink        template.URL // The custom scheme url to open, only set after checking the scheme is allowed
+	FallbackURL     string       // The web page to go to if the app does not open, empty if the link has none
+	FallbackDelayMs int          // How long to wait for the app before going to FallbackURL
+	ShortURL        string       // The short url of the link
+	IsLoggedIn      bool         // Used by the navbar to change what appears based on if a user is logged in
+}
+
+/*
+* Struct: LinkPasswordData
+*
+* Description: This struct is used to pass data to the page that asks for the password of a protected link.
+*
+ */
+type LinkPasswordData struct {
+	FormAction string // The path the password form is posted back to, with the query string of the short link
+	ShortURL   string // The short url of the link
+	HasError   bool   // If the password was wrong or too many attempts were made
+	ErrorText  string // The error text to display if the form was submitted with errors
+	IsLoggedIn bool   // Used by the navbar to change what appears based on if a user is logged in
+}
+
+/*
+* Struct: SocialPreviewData
+*
+* Description: This struct is used to pass data to the page served to link preview crawlers in place of a redirect.
+*
+ */
+type SocialPreviewData struct {
+	Title       string // The og:title of the page
+	Description string // The og:description of the page
+	Image       string // The og:image of the page
+	ShortURL    string // The short url that was requested
+	Url         string // The destination the page refreshes to
 }
@@ -0,0 +1,122 @@
+/*
+* File: internal/sessmngt/attempt_limiter.go
+*
+* Description: Contains a limiter for failed password attempts, used to slow down guessing of passwords
+ */
+
+package sessmngt
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of keys tracked before expired entries are swept out
+const attemptLimiterSweepSize = 1024
+
+/*
+* Struct: AttemptLimiter
+*
+* Description: Counts attempts per key, such as a client address and the thing being unlocked, and blocks a key
+*              once it has made too many within a window without succeeding. The count resets when the window that
+*              started with the first attempt ends. It is safe to use from several goroutines
+ */
+type AttemptLimiter struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	attempts map[string]*failedAttempts
+}
+
+/*
+* Struct: failedAttempts
+*
+* Description: The attempts of one key within the current window
+ */
+type failedAttempts struct {
+	count int       // The number of attempts since start
+	start time.Time // When the first attempt of the window happened
+}
+
+/*
+* Function: NewAttemptLimiter
+*
+* Parameters: max    int           - The number of failures allowed within a window
+*             window time.Duration - How long failures are remembered
+*
+* Returns: *AttemptLimiter - A limiter with no recorded failures
+*
+* Description: Creates a limiter for failed attempts
+*
+ */
+func NewAttemptLimiter(max int, window time.Duration) *AttemptLimiter {
+	return &AttemptLimiter{max: max, window: window, attempts: make(map[string]*failedAttempts)}
+}
+
+/*
+* Function: AttemptLimiter.Attempt
+*
+* Parameters: key string - Identifies who is attempting what
+*
+* Returns: bool - false if the key has used up its attempts for the current window, nothing is recorded then
+*
+* Description: Checks whether another attempt may be made and counts it as a failure in the same step, so attempts
+*              made in parallel cannot all pass the check before any of them is recorded. Call this before checking
+*              the password and Reset if it was correct, starting a new window if the previous one has ended
+*
+ */
+func (l *AttemptLimiter) Attempt(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := l.attempts[key]
+	if !ok || now.Sub(entry.start) >= l.window {
+		if len(l.attempts) >= attemptLimiterSweepSize {
+			l.sweep(now)
+		}
+		l.attempts[key] = &failedAttempts{count: 1, start: now}
+		return true
+	}
+
+	if entry.count >= l.max {
+		return false
+	}
+	entry.count++
+	return true
+}
+
+/*
+* Function: AttemptLimiter.Reset
+*
+* Parameters: key string - Identifies who is attempting what
+*
+* Returns: None
+*
+* Description: Forgets the failures of a key, including the attempt that just succeeded
+*
+ */
+func (l *AttemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, key)
+}
+
+/*
+* Function: AttemptLimiter.sweep
+*
+* Parameters: now time.Time - The current time
+*
+* Returns: None
+*
+* Description: Removes keys whose window has ended so the map does not grow without bound. The lock must be held
+*
+ */
+func (l *AttemptLimiter) sweep(now time.Time) {
+	for key, entry := range l.attempts {
+		if now.Sub(entry.start) >= l.window {
+			delete(l.attempts, key)
+		}
+	}
+}
@@ -308,3 +308,126 @@ func GetUserId(db *sql.DB, email string) (int, error) {
 
 	return id, nil
 }
+
+/*
+* Name: UpdateUserPassword
+*
+* Parameters: db *sql.DB - The application database
+*             email string - The email of the user whose password is changed
+*             hashedPassword string - The new password, already hashed with HashPassword
+*
+* Description: This function replaces the stored password hash of the user with the specified email.
+*
+* Returns: error - sql.ErrNoRows if no user has the email, or any error from the update.
+ */
+func UpdateUserPassword(db *sql.DB, email string, hashedPassword string) error {
+	result, err := db.Exec("UPDATE users SET password = ? WHERE email = ?", hashedPassword, email)
+	if err != nil {
+		return err
+	}
+
+	return RequireRowsAffected(result)
+}
+
+/*
+* Name: SetUserPermissions
+*
+* Parameters: db *sql.DB - The application database
+*             email string - The email of the user to change
+*             permissions string - The new access level of the user, "user" or "admin"
+*
+* Description: This function changes the access level of the user with the specified email.
+*
+* Returns: error - sql.ErrNoRows if no user has the email, or any error from the update.
+ */
+func SetUserPermissions(db *sql.DB, email string, permissions string) error {
+	result, err := db.Exec("UPDATE users SET permissions = ? WHERE email = ?", permissions, email)
+	if err != nil {
+		return err
+	}
+
+	return RequireRowsAffected(result)
+}
+
+/*
+* Name: RequireRowsAffected
+*
+* Parameters: result sql.Result - The result of an update or delete
+*
+* Description: Converts an update or delete that matched no rows into sql.ErrNoRows, the same error a query that
+*              found nothing returns.
+*
+* Returns: error - sql.ErrNoRows if the statement did not change any rows.
+ */
+func RequireRowsAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+/*
+* Function: DeleteUserSessions
+*
+* Parameters: db *sql.DB - The application database
+*             userId int - The id of the user whose sessions are deleted
+*
+* Returns: int64 - The number of sessions deleted
+*          error
+*
+* Description: Deletes every session of a user, which logs them out everywhere
+*
+ */
+func DeleteUserSessions(db *sql.DB, userId int) (int64, error) {
+	result, err := db.Exec("DELETE FROM sessions WHERE userId = ?", userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+/*
+* Function: DeleteExpiredSessions
+*
+* Parameters: db *sql.DB - The application database
+*
+* Returns: int64 - The number of sessions deleted
+*          error
+*
+* Description: Deletes every session whose expiry time has passed
+*
+ */
+func DeleteExpiredSessions(db *sql.DB) (int64, error) {
+	result, err := db.Exec("DELETE FROM sessions WHERE expiryTimeUnix <= ?", time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+/*
+* Function: DeleteAllSessions
+*
+* Parameters: db *sql.DB - The application database
+*
+* Returns: int64 - The number of sessions deleted
+*          error
+*
+* Description: Deletes every session in the database, which logs out every user
+*
+ */
+func DeleteAllSessions(db *sql.DB) (int64, error) {
+	result, err := db.Exec("DELETE FROM sessions")
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -44,7 +44,7 @@ func HandleLoginPage(c echo.Context, data *globalstructs.LoginData, config *conf
 * Returns: error
 *
 * Description: Handles a POST request made to /login to create the session cookie and redirect the user to the
-*              user homepage
+*              user homepage, or to the page given to SetReturnTo
 *
  */
 func HandleLoginSession(c echo.Context, data *globalstructs.LoginData, config *conf.Config) error {
@@ -126,6 +126,8 @@ func HandleLoginSession(c echo.Context, data *globalstructs.LoginData, config *c
 		return c.Render(200, "login-form", data)
 	}
 
+	redirect := popReturnTo(sess)
+
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
 		data.HasError = true
 		data.ErrorText = "Error saving session 3"
@@ -136,7 +138,7 @@ func HandleLoginSession(c echo.Context, data *globalstructs.LoginData, config *c
 
 	data.HasError = false
 
-	c.Response().Header().Set("HX-Redirect", "/user")
+	c.Response().Header().Set("HX-Redirect", redirect)
 	return c.String(http.StatusMovedPermanently, "redirecting")
 }
 
@@ -11,7 +11,7 @@ import (
 	"errors"
 	"math"
 	"math/big"
-	"net"
+	"strings"
 	"unicode"
 
 	"github.com/gorilla/sessions"
@@ -62,14 +62,8 @@ func CheckCaptcha(c echo.Context, secretkey string) error {
 	// Create a captcha object
 	hc := hcaptcha.New(secretkey) //lint:ignore
 
-	// Get the remote address of the request
-	ip, _, err := net.SplitHostPort(c.Request().RemoteAddr)
-	if err != nil {
-		return err
-	}
-
-	// Verify the captcha response with hCaptcha's servers
-	resp, err := hc.Verify(captchaResponse, ip)
+	// Verify the captcha response with hCaptcha's servers, RealIP gives the client's address behind a trusted proxy
+	resp, err := hc.Verify(captchaResponse, c.RealIP())
 	if err != nil {
 		return err
 	}
@@ -120,6 +114,47 @@ func InvalidateSession(sess *sessions.Session, c echo.Context) error {
 	return nil
 }
 
+// The session value holding the page a user is sent to once they log in
+const returnToKey = "returnTo"
+
+/*
+* Function: SetReturnTo
+*
+* Parameters: sess *sessions.Session - The gorilla sessions session of the current request
+*             path string            - The local path to send the user to after they log in
+*
+* Returns: None
+*
+* Description: Remembers a page that needs the user to be logged in, so that logging in takes them back to it.
+*              This function does not save the session
+*
+ */
+func SetReturnTo(sess *sessions.Session, path string) {
+	sess.Values[returnToKey] = path
+}
+
+/*
+* Function: popReturnTo
+*
+* Parameters: sess *sessions.Session - The gorilla sessions session of the current request
+*
+* Returns: string - The path given to SetReturnTo, or /user if there is none
+*
+* Description: Removes the remembered page from the session and returns it. Only paths on this server are
+*              returned so that the value can never redirect the user to another site
+*
+ */
+func popReturnTo(sess *sessions.Session) string {
+	path, _ := sess.Values[returnToKey].(string)
+	delete(sess.Values, returnToKey)
+
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/user"
+	}
+
+	return path
+}
+
 /*
 * Function: SetSessionCookie
 *
@@ -7,6 +7,8 @@ package codegen
 import (
 	"math"
 	"math/rand"
+	"strings"
+	"unicode"
 )
 
 /*
@@ -89,3 +91,82 @@ func UniverseToBaseTen(input string, universe string) int {
 
 	return result
 }
+
+// Characters that are easily mistaken for one another when a shortcode is read aloud or printed
+const Confusables = "0Oo1lIi"
+
+/*
+* Function: HasConfusables
+*
+* Parameters: code string - The shortcode to check
+*
+* Returns: bool - true if the shortcode contains any character found in Confusables
+*
+* Description: Checks if a shortcode contains characters that could be misread, such as l/1/I or O/0
+ */
+func HasConfusables(code string) bool {
+	return strings.ContainsAny(code, Confusables)
+}
+
+/*
+* Function: ContainsDenied
+*
+* Parameters: code     string   - The shortcode to check
+*             denylist []string - The substrings that are not allowed to appear in a shortcode
+*
+* Returns: bool - true if any entry of the denylist appears in the shortcode
+*
+* Description: Checks the shortcode against the denylist. The comparison is case-insensitive so that a single
+*              lowercase entry covers every capitalisation of a word
+ */
+func ContainsDenied(code string, denylist []string) bool {
+	lowerCode := strings.ToLower(code)
+	for _, denied := range denylist {
+		if denied == "" {
+			continue
+		}
+		if strings.Contains(lowerCode, strings.ToLower(denied)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+* Function: IsSingleCase
+*
+* Parameters: universe string - The set of characters used to generate shortcodes
+*
+* Returns: bool - false if the universe contains any uppercase letter and any lowercase letter, true otherwise
+*
+* Description: A universe is single-case when all of its letters share one case, so converting a shortcode to that
+*              case can never turn it into a different shortcode, which makes case-insensitive lookups safe. A
+*              universe such as "aB" counts as mixed-case even though no letter appears in both cases
+ */
+func IsSingleCase(universe string) bool {
+	return !strings.ContainsFunc(universe, unicode.IsUpper) || !strings.ContainsFunc(universe, unicode.IsLower)
+}
+
+/*
+* Function: NormalizeCase
+*
+* Parameters: code     string - The shortcode to normalize, usually taken from a request
+*             universe string - The set of characters used to generate shortcodes
+*
+* Returns: string - The shortcode converted to the case used by the universe
+*
+* Description: If the universe is single-case the shortcode is converted to that case so that "AbC" and "abc" resolve
+*              to the same link. Shortcodes for mixed-case universes are returned unchanged
+ */
+func NormalizeCase(code string, universe string) string {
+	if !IsSingleCase(universe) {
+		return code
+	}
+
+	if strings.ContainsFunc(universe, unicode.IsUpper) {
+		return strings.ToUpper(code)
+	}
+
+	return strings.ToLower(code)
+}
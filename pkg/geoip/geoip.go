@@ -0,0 +1,209 @@
+/*
+* File: pkg/geoip/geoip.go
+*
+* Description: Looks up the country of IP addresses in a local database file, so visitors can be routed by
+*              country without calling an outside service. The file is a CSV of address ranges, one per line:
+*
+*                  start,end,country
+*
+*              where start and end are IPv4 or IPv6 addresses, or the decimal numbers used by IP2Location LITE,
+*              and country is a two letter ISO 3166 code. Further columns, such as a country name, are ignored.
+*              The free country lite CSVs of DB-IP and IP2Location can be used as they are
+*
+ */
+
+package geoip
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+* Struct: DB
+*
+* Description: The address ranges of a database file, sorted by their first address. A DB is read-only once
+*              loaded and safe to use from several goroutines
+ */
+type DB struct {
+	ranges []addrRange
+}
+
+/*
+* Struct: addrRange
+*
+* Description: A range of addresses that belong to one country
+ */
+type addrRange struct {
+	start   netip.Addr // The first address of the range
+	end     netip.Addr // The last address of the range
+	country string     // The uppercased country code
+}
+
+/*
+* Function: Open
+*
+* Parameters: path string - The path of the CSV database file
+*
+* Returns: *DB   - The loaded database
+*          error - If the file cannot be read or a line cannot be parsed
+*
+* Description: Loads a database file into memory
+ */
+func Open(path string) (*DB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Load(file)
+}
+
+/*
+* Function: Load
+*
+* Parameters: r io.Reader - The CSV database
+*
+* Returns: *DB   - The loaded database
+*          error - If a line cannot be parsed
+*
+* Description: Reads a database from r. Ranges without a country, such as reserved networks marked "-" or "ZZ",
+*              are skipped
+ */
+func Load(r io.Reader) (*DB, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	db := &DB{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(record) < 3 {
+			return nil, fmt.Errorf("geoip: line %d: expected start, end and country", line)
+		}
+
+		country := strings.ToUpper(strings.TrimSpace(record[2]))
+		if len(country) != 2 || country == "ZZ" {
+			continue
+		}
+
+		start, err := parseAddr(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("geoip: line %d: %w", line, err)
+		}
+		end, err := parseAddr(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("geoip: line %d: %w", line, err)
+		}
+		if start.Is4() != end.Is4() || end.Less(start) {
+			return nil, fmt.Errorf("geoip: line %d: invalid range %s - %s", line, start, end)
+		}
+
+		db.ranges = append(db.ranges, addrRange{start: start, end: end, country: country})
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].start.Less(db.ranges[j].start)
+	})
+
+	return db, nil
+}
+
+/*
+* Function: DB.Country
+*
+* Parameters: ip string - An IPv4 or IPv6 address
+*
+* Returns: string - The two letter code of the country the address is in, empty if it is unknown
+*
+* Description: Finds the range an address is in. A nil DB knows no addresses
+ */
+func (db *DB) Country(ip string) string {
+	if db == nil {
+		return ""
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+
+	// The last range that starts at or before the address is the only one that can contain it
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].start)
+	})
+	if i == 0 {
+		return ""
+	}
+
+	candidate := db.ranges[i-1]
+	if candidate.end.Less(addr) || candidate.start.Is4() != addr.Is4() {
+		return ""
+	}
+	return candidate.country
+}
+
+/*
+* Function: DB.Len
+*
+* Parameters: None
+*
+* Returns: int - The number of ranges loaded
+*
+* Description: Used to report the size of the database after loading it
+ */
+func (db *DB) Len() int {
+	if db == nil {
+		return 0
+	}
+	return len(db.ranges)
+}
+
+/*
+* Function: parseAddr
+*
+* Parameters: field string - An address or the decimal number of one
+*
+* Returns: netip.Addr - The address, IPv4-mapped IPv6 addresses are returned as IPv4
+*          error      - If the field is neither
+*
+* Description: Parses the start or end of a range
+ */
+func parseAddr(field string) (netip.Addr, error) {
+	field = strings.TrimSpace(field)
+
+	addr, err := netip.ParseAddr(field)
+	if err == nil {
+		return addr.Unmap(), nil
+	}
+
+	number, ok := new(big.Int).SetString(field, 10)
+	if !ok || number.Sign() < 0 || number.BitLen() > 128 {
+		return netip.Addr{}, errors.New("invalid address " + field)
+	}
+
+	if number.BitLen() <= 32 {
+		var bytes [4]byte
+		number.FillBytes(bytes[:])
+		return netip.AddrFrom4(bytes), nil
+	}
+
+	var bytes [16]byte
+	number.FillBytes(bytes[:])
+	return netip.AddrFrom16(bytes).Unmap(), nil
+}
@@ -0,0 +1,424 @@
+/*
+* File: pkg/metafetch/metafetch.go
+*
+* Description: Fetches the title, description and favicon of a web page. Requests are limited in time and size, and
+*              by default only connect to public IP addresses so that user supplied urls cannot be used to reach
+*              services on the server's own network
+*
+ */
+
+package metafetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Defaults used for Options fields that are left at zero
+const (
+	DefaultTimeout      = 5 * time.Second
+	DefaultMaxBytes     = 1 << 20
+	DefaultMaxRedirects = 5
+)
+
+// The longest title and description kept, longer values are cut off
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 1000
+)
+
+// Returned when a url resolves to an address that is not publicly routable
+var ErrForbiddenAddress = errors.New("metafetch: destination address is not allowed")
+
+// Address ranges that are not covered by the net.IP classification methods but are still not public
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",     // This network
+	"100.64.0.0/10", // Carrier grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // Benchmarking
+	"240.0.0.0/4",   // Reserved, including broadcast
+	"64:ff9b::/96",  // NAT64, which can map to private IPv4 addresses
+)
+
+/*
+* Struct: Metadata
+*
+* Description: The information describing a web page
+ */
+type Metadata struct {
+	Title       string // The OpenGraph title of the page, or its <title>
+	Description string // The OpenGraph or meta description of the page
+	FaviconURL  string // The absolute url of the page's icon, /favicon.ico on the same host when none is declared
+}
+
+/*
+* Struct: Options
+*
+* Description: Limits for fetching pages, zero values use the package defaults
+ */
+type Options struct {
+	Timeout      time.Duration // The maximum time for a whole fetch, including redirects
+	MaxBytes     int64         // The maximum number of bytes of the page that are read
+	MaxRedirects int           // The maximum number of redirects followed
+	UserAgent    string        // The User-Agent header sent with requests
+	AllowPrivate bool          // Allow connections to loopback and private addresses, for intranets and testing
+}
+
+/*
+* Struct: Fetcher
+*
+* Description: Fetches page metadata with a fixed set of limits. A Fetcher is safe to use from several goroutines
+ */
+type Fetcher struct {
+	client    *http.Client
+	maxBytes  int64
+	userAgent string
+}
+
+/*
+* Function: New
+*
+* Parameters: opts Options - The limits to apply to every fetch
+*
+* Returns: *Fetcher - A fetcher using its own http client
+*
+* Description: Creates a fetcher. Unless AllowPrivate is set, every connection, including those made for redirects,
+*              is checked after the host name is resolved so that DNS cannot be used to reach a private address
+ */
+func New(opts Options) *Fetcher {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxRedirects <= 0 {
+		opts.MaxRedirects = DefaultMaxRedirects
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = "go-link-shortener metadata fetcher"
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivate {
+		dialer.Control = rejectPrivateAddresses
+	}
+
+	// The proxy from the environment is ignored, it would make the address checks apply to the proxy instead
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > opts.MaxRedirects {
+				return errors.New("metafetch: too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("metafetch: redirect to unsupported scheme " + req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+
+	return &Fetcher{client: client, maxBytes: opts.MaxBytes, userAgent: opts.UserAgent}
+}
+
+/*
+* Function: Fetcher.Fetch
+*
+* Parameters: ctx    context.Context - Cancels the fetch
+*             rawURL string          - The http or https url of the page
+*
+* Returns: *Metadata - The metadata found in the head of the page
+*          error     - If the page could not be fetched or is not HTML
+*
+* Description: Downloads the start of a page and reads its metadata. Only the head of the document is parsed, and
+*              at most MaxBytes are read
+ */
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Metadata, error) {
+	pageURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if pageURL.Scheme != "http" && pageURL.Scheme != "https" {
+		return nil, errors.New("metafetch: unsupported scheme " + pageURL.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("metafetch: unexpected status %s", resp.Status)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+			return nil, errors.New("metafetch: page is not HTML")
+		}
+	}
+
+	// Relative icon urls are resolved against the final url after any redirects
+	meta := parseHead(io.LimitReader(resp.Body, f.maxBytes), resp.Request.URL)
+	return meta, nil
+}
+
+/*
+* Function: parseHead
+*
+* Parameters: r       io.Reader - The HTML document
+*             pageURL *url.URL  - The url the document was loaded from
+*
+* Returns: *Metadata - The metadata found in the document
+*
+* Description: Reads title, meta and link tags until the end of the head. OpenGraph values are preferred over the
+*              plain title and description
+ */
+func parseHead(r io.Reader, pageURL *url.URL) *Metadata {
+	var title, ogTitle, description, ogDescription, icon string
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(r)
+tokens:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// The end of the document, or the size limit was reached
+			break tokens
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				property := strings.ToLower(attr(token, "property"))
+				name := strings.ToLower(attr(token, "name"))
+				content := attr(token, "content")
+				switch {
+				case property == "og:title":
+					ogTitle = content
+				case property == "og:description":
+					ogDescription = content
+				case name == "description":
+					description = content
+				}
+			case "link":
+				if icon == "" && isIconRel(attr(token, "rel")) {
+					icon = attr(token, "href")
+				}
+			case "body":
+				break tokens
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				break tokens
+			}
+		}
+	}
+
+	meta := &Metadata{
+		Title:       clean(firstNonEmpty(ogTitle, title), maxTitleLength),
+		Description: clean(firstNonEmpty(ogDescription, description), maxDescriptionLength),
+	}
+
+	iconURL, err := pageURL.Parse(firstNonEmpty(strings.TrimSpace(icon), "/favicon.ico"))
+	if err == nil && (iconURL.Scheme == "http" || iconURL.Scheme == "https") {
+		meta.FaviconURL = iconURL.String()
+	}
+
+	return meta
+}
+
+/*
+* Function: rejectPrivateAddresses
+*
+* Parameters: network string          - The network being dialed
+*             address string          - The resolved ip and port being connected to
+*             conn    syscall.RawConn - Unused
+*
+* Returns: error - ErrForbiddenAddress if the address is not publicly routable
+*
+* Description: Used as the Control function of the dialer, which runs after DNS resolution for every connection
+ */
+func rejectPrivateAddresses(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublicIP(ip) {
+		return ErrForbiddenAddress
+	}
+
+	return nil
+}
+
+/*
+* Function: IsPublicIP
+*
+* Parameters: ip net.IP - The address to check
+*
+* Returns: bool - true if the address is a globally routable unicast address
+*
+* Description: Rejects loopback, private, link-local, multicast, unspecified and other reserved addresses. IPv4
+*              addresses mapped into IPv6 are checked as IPv4
+ */
+func IsPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+* Function: isIconRel
+*
+* Parameters: rel string - The rel attribute of a link tag
+*
+* Returns: bool - true if the link declares an icon for the page
+*
+* Description: Matches "icon", "shortcut icon" and "apple-touch-icon"
+ */
+func isIconRel(rel string) bool {
+	for _, value := range strings.Fields(strings.ToLower(rel)) {
+		if value == "icon" || value == "apple-touch-icon" {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Function: attr
+*
+* Parameters: token html.Token - A start tag
+*             name  string     - The name of the attribute
+*
+* Returns: string - The value of the attribute, empty if the tag does not have it
+*
+* Description: Reads an attribute of a tag
+ */
+func attr(token html.Token, name string) string {
+	for _, attribute := range token.Attr {
+		if attribute.Key == name {
+			return attribute.Val
+		}
+	}
+	return ""
+}
+
+/*
+* Function: clean
+*
+* Parameters: text   string - Text from the page
+*             length int    - The maximum length in bytes
+*
+* Returns: string - The text with whitespace collapsed, cut off at a character boundary if it was too long
+*
+* Description: Tidies text read from a page before it is stored
+ */
+func clean(text string, length int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if !utf8.ValidString(text) {
+		text = strings.ToValidUTF8(text, "")
+	}
+	if len(text) <= length {
+		return text
+	}
+
+	cut := length
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut]
+}
+
+/*
+* Function: firstNonEmpty
+*
+* Parameters: values ...string - Candidate values in order of preference
+*
+* Returns: string - The first value that is not empty
+*
+* Description: Picks the preferred value that is present
+ */
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+/*
+* Function: mustParseCIDRs
+*
+* Parameters: cidrs ...string - Networks in CIDR notation
+*
+* Returns: []*net.IPNet - The parsed networks
+*
+* Description: Parses a fixed list of networks, panicking if one is invalid
+ */
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
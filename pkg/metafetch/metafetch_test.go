@@ -0,0 +1,238 @@
+/*
+* File: pkg/metafetch/metafetch_test.go
+*
+* Description: Tests for fetching page metadata, run against local httptest servers. AllowPrivate is enabled for
+*              every test except the ones checking that private addresses are refused
+*
+ */
+
+package metafetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+* Function: newPageServer
+*
+* Parameters: t    *testing.T - The test the server belongs to
+*             page string     - The HTML served for every path
+*
+* Returns: *httptest.Server - A server that is closed when the test ends
+*
+* Description: Serves a fixed HTML page
+ */
+func newPageServer(t *testing.T, page string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchExtractsMetadata(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want Metadata
+	}{
+		{
+			name: "OpenGraph preferred",
+			page: `<html><head><title>Plain title</title>
+				<meta name="description" content="Plain description">
+				<meta property="og:title" content="OG title">
+				<meta property="og:description" content="OG description">
+				<link rel="shortcut icon" href="/static/icon.png">
+				</head><body><title>Not this</title></body></html>`,
+			want: Metadata{Title: "OG title", Description: "OG description", FaviconURL: "/static/icon.png"},
+		},
+		{
+			name: "Plain tags",
+			page: `<html><head><title>
+				Plain   title </title><meta name="Description" content="Plain description"></head></html>`,
+			want: Metadata{Title: "Plain title", Description: "Plain description", FaviconURL: "/favicon.ico"},
+		},
+		{
+			name: "Head ends before the body tags",
+			page: `<html><head><title>Title</title></head>
+				<body><meta name="description" content="In the body"><link rel="icon" href="/body.png"></body></html>`,
+			want: Metadata{Title: "Title", FaviconURL: "/favicon.ico"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newPageServer(t, test.page)
+			fetcher := New(Options{AllowPrivate: true})
+
+			meta, err := fetcher.Fetch(context.Background(), server.URL+"/page")
+			if err != nil {
+				t.Fatalf("Fetch returned an error: %s", err)
+			}
+
+			// Icon urls are resolved against the page
+			test.want.FaviconURL = server.URL + test.want.FaviconURL
+			if *meta != test.want {
+				t.Errorf("Fetch = %+v, want %+v", *meta, test.want)
+			}
+		})
+	}
+}
+
+func TestFetchRejectsNonHTML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"title": "json"}`)
+	}))
+	defer server.Close()
+
+	_, err := New(Options{AllowPrivate: true}).Fetch(context.Background(), server.URL)
+	if err == nil {
+		t.Fatal("Fetch accepted a JSON response")
+	}
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	// The title comes after more padding than the limit allows
+	page := "<html><head><!--" + strings.Repeat("x", 4096) + "--><title>Too late</title></head></html>"
+	server := newPageServer(t, page)
+
+	meta, err := New(Options{AllowPrivate: true, MaxBytes: 1024}).Fetch(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %s", err)
+	}
+	if meta.Title != "" {
+		t.Errorf("Title = %q, want nothing read past MaxBytes", meta.Title)
+	}
+
+	meta, err = New(Options{AllowPrivate: true, MaxBytes: 8192}).Fetch(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("Fetch returned an error: %s", err)
+	}
+	if meta.Title != "Too late" {
+		t.Errorf("Title = %q, want %q with a larger limit", meta.Title, "Too late")
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	start := time.Now()
+	_, err := New(Options{AllowPrivate: true, Timeout: 200 * time.Millisecond}).Fetch(context.Background(), server.URL)
+	if err == nil {
+		t.Fatal("Fetch of a page that never answers succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Fetch took %s, want it to stop after the timeout", elapsed)
+	}
+}
+
+func TestFetchRedirectCap(t *testing.T) {
+	// /hop/n redirects to /hop/n+1, except /hop/3 which is the page
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hop int
+		fmt.Sscanf(r.URL.Path, "/hop/%d", &hop)
+		if hop < 3 {
+			http.Redirect(w, r, fmt.Sprintf("/hop/%d", hop+1), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<title>Arrived</title>")
+	}))
+	defer server.Close()
+
+	meta, err := New(Options{AllowPrivate: true, MaxRedirects: 3}).Fetch(context.Background(), server.URL+"/hop/0")
+	if err != nil {
+		t.Fatalf("Fetch with 3 redirects and a cap of 3 returned an error: %s", err)
+	}
+	if meta.Title != "Arrived" {
+		t.Errorf("Title = %q, want %q", meta.Title, "Arrived")
+	}
+
+	_, err = New(Options{AllowPrivate: true, MaxRedirects: 2}).Fetch(context.Background(), server.URL+"/hop/0")
+	if err == nil || !strings.Contains(err.Error(), "too many redirects") {
+		t.Errorf("Fetch with 3 redirects and a cap of 2 returned %v, want too many redirects", err)
+	}
+}
+
+func TestFetchRefusesPrivateAddresses(t *testing.T) {
+	server := newPageServer(t, "<title>Internal</title>")
+
+	_, err := New(Options{}).Fetch(context.Background(), server.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("Fetch of %s returned %v, want ErrForbiddenAddress", server.URL, err)
+	}
+}
+
+func TestFetchRefusesRedirectToLoopback(t *testing.T) {
+	internal := newPageServer(t, "<title>Internal</title>")
+	public := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusFound))
+	defer public.Close()
+
+	// The test servers all listen on loopback, so the first server stands in for a public site by letting its
+	// address through. Every other connection gets the normal check
+	fetcher := New(Options{})
+	publicAddr := public.Listener.Addr().String()
+	dialer := &net.Dialer{
+		Timeout: DefaultTimeout,
+		Control: func(network, address string, conn syscall.RawConn) error {
+			if address == publicAddr {
+				return nil
+			}
+			return rejectPrivateAddresses(network, address, conn)
+		},
+	}
+	fetcher.client.Transport.(*http.Transport).DialContext = dialer.DialContext
+
+	_, err := fetcher.Fetch(context.Background(), public.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("Fetch redirected to %s returned %v, want ErrForbiddenAddress", internal.URL, err)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+
+	for _, test := range tests {
+		if got := IsPublicIP(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("IsPublicIP(%s) = %t, want %t", test.ip, got, test.want)
+		}
+	}
+}
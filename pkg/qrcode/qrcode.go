@@ -0,0 +1,803 @@
+/*
+* File: pkg/qrcode/qrcode.go
+*
+* Description: A QR code encoder for binary data. Data is always encoded in byte mode using the smallest version
+*              (1 to 40) that fits at the requested error correction level, and the mask with the lowest penalty
+*              score is chosen. See rendering.go for turning a code into an image
+*
+ */
+
+package qrcode
+
+import (
+	"errors"
+	"strings"
+)
+
+/*
+* Type: Level
+*
+* Description: The error correction level of a QR code. Higher levels can be read when more of the code is damaged
+*              or covered, at the cost of a larger code
+ */
+type Level int
+
+const (
+	Low      Level = iota // Recovers about 7% of the code
+	Medium                // Recovers about 15% of the code
+	Quartile              // Recovers about 25% of the code
+	High                  // Recovers about 30% of the code
+)
+
+// Returned by Encode when the data does not fit in a version 40 code at the requested level
+var ErrTooLong = errors.New("qrcode: data is too long")
+
+// The two bits identifying each level in the format information, indexed by Level
+var levelFormatBits = [4]int{1, 0, 3, 2}
+
+// The number of error correction codewords in each block, indexed by Level then version
+var eccCodewordsPerBlock = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+// The number of error correction blocks the codewords are split into, indexed by Level then version
+var eccBlocks = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+/*
+* Struct: Code
+*
+* Description: An encoded QR code. Modules are addressed by column x and row y, starting from the top left corner
+*              and not including the quiet zone
+ */
+type Code struct {
+	Version int   // The version of the code, from 1 to 40
+	Size    int   // The width and height of the code in modules
+	Level   Level // The error correction level of the code
+
+	modules    []bool // true for dark modules, stored row by row
+	isFunction []bool // true for modules that are part of a function pattern and are never masked
+}
+
+/*
+* Function: ParseLevel
+*
+* Parameters: s string - One of L, M, Q or H, in either case
+*
+* Returns: Level - The error correction level
+*          error - If s is not a level
+*
+* Description: Converts the usual single letter name of an error correction level into a Level
+ */
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return Low, nil
+	case "M":
+		return Medium, nil
+	case "Q":
+		return Quartile, nil
+	case "H":
+		return High, nil
+	default:
+		return 0, errors.New("qrcode: unknown error correction level " + s)
+	}
+}
+
+/*
+* Function: Encode
+*
+* Parameters: data  []byte - The data to encode
+*             level Level  - The error correction level to use
+*
+* Returns: *Code - The encoded QR code
+*          error - ErrTooLong if the data does not fit in any version, or an error if the level is invalid
+*
+* Description: Encodes data in byte mode into the smallest QR code that holds it at the given level
+ */
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < Low || level > High {
+		return nil, errors.New("qrcode: invalid error correction level")
+	}
+
+	// Find the smallest version the mode indicator, character count and data fit in
+	version := 1
+	for ; version <= 40; version++ {
+		if 4+countBits(version)+8*len(data) <= 8*dataCodewords(version, level) {
+			break
+		}
+	}
+	if version > 40 {
+		return nil, ErrTooLong
+	}
+
+	codewords := addErrorCorrection(encodeData(data, version, level), version, level)
+
+	code := &Code{Version: version, Size: version*4 + 17, Level: level}
+	code.modules = make([]bool, code.Size*code.Size)
+	code.isFunction = make([]bool, code.Size*code.Size)
+	code.drawFunctionPatterns()
+	code.drawCodewords(codewords)
+
+	// Try every mask and keep the one with the lowest penalty, applying a mask twice undoes it
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		code.applyMask(mask)
+		code.drawFormatBits(mask)
+		penalty := code.penalty()
+		if bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		code.applyMask(mask)
+	}
+	code.applyMask(bestMask)
+	code.drawFormatBits(bestMask)
+
+	return code, nil
+}
+
+/*
+* Function: Code.Dark
+*
+* Parameters: x int - The column of the module
+*             y int - The row of the module
+*
+* Returns: bool - true if the module is dark, modules outside the code are part of the light quiet zone
+*
+* Description: Reports the color of a module
+ */
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y*c.Size+x]
+}
+
+/*
+* Function: countBits
+*
+* Parameters: version int - The version of the code
+*
+* Returns: int - The width of the character count field for byte mode
+*
+* Description: Byte mode counts use 8 bits in versions 1 to 9 and 16 bits in larger versions
+ */
+func countBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+/*
+* Function: rawDataModules
+*
+* Parameters: version int - The version of the code
+*
+* Returns: int - The number of modules available for data and error correction, including remainder bits
+*
+* Description: Counts the modules of a version that are not taken by function patterns or format information
+ */
+func rawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		alignments := version/7 + 2
+		result -= (25*alignments-10)*alignments - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+/*
+* Function: dataCodewords
+*
+* Parameters: version int   - The version of the code
+*             level   Level - The error correction level
+*
+* Returns: int - The number of 8 bit data codewords the code holds
+*
+* Description: The raw codewords of a version less those used for error correction
+ */
+func dataCodewords(version int, level Level) int {
+	return rawDataModules(version)/8 - eccCodewordsPerBlock[level][version]*eccBlocks[level][version]
+}
+
+/*
+* Function: encodeData
+*
+* Parameters: data    []byte - The data to encode
+*             version int    - The version of the code
+*             level   Level  - The error correction level
+*
+* Returns: []byte - The data codewords, padded to fill the capacity of the code
+*
+* Description: Writes the byte mode segment, the terminator and the pad codewords
+ */
+func encodeData(data []byte, version int, level Level) []byte {
+	capacity := dataCodewords(version, level)
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(data), countBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	// Up to four zero bits terminate the data, then it is padded to a whole byte
+	terminator := capacity*8 - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+
+	result := bits.bytes()
+	for pad := byte(0xEC); len(result) < capacity; pad ^= 0xEC ^ 0x11 {
+		result = append(result, pad)
+	}
+
+	return result
+}
+
+/*
+* Function: addErrorCorrection
+*
+* Parameters: data    []byte - The data codewords
+*             version int    - The version of the code
+*             level   Level  - The error correction level
+*
+* Returns: []byte - The data and error correction codewords in the order they are placed in the code
+*
+* Description: Splits the data into blocks, computes the Reed-Solomon error correction codewords of each block
+*              and interleaves the blocks. Later blocks hold one more data codeword than earlier ones when the
+*              codewords do not divide evenly
+ */
+func addErrorCorrection(data []byte, version int, level Level) []byte {
+	numBlocks := eccBlocks[level][version]
+	eccLen := eccCodewordsPerBlock[level][version]
+	rawCodewords := rawDataModules(version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := reedSolomonDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	offset := 0
+	for i := range blocks {
+		dataLen := shortBlockLen - eccLen
+		if i >= numShortBlocks {
+			dataLen++
+		}
+
+		block := make([]byte, 0, shortBlockLen+1)
+		block = append(block, data[offset:offset+dataLen]...)
+		offset += dataLen
+		ecc := reedSolomonRemainder(block, divisor)
+
+		// Short blocks get a placeholder so every block has the same length, it is skipped when interleaving
+		if i < numShortBlocks {
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortBlockLen-eccLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+
+	return result
+}
+
+/*
+* Function: Code.drawFunctionPatterns
+*
+* Parameters: None
+*
+* Returns: None
+*
+* Description: Draws the finder, timing and alignment patterns and the version information, and reserves the
+*              format information area
+ */
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.Size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	positions := alignmentPositions(c.Version)
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// Alignment patterns never overlap the finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format information, the real bits are drawn once a mask is chosen
+	c.drawFormatBits(0)
+	c.drawVersion()
+}
+
+/*
+* Function: Code.drawFinder
+*
+* Parameters: x int - The column of the center of the pattern
+*             y int - The row of the center of the pattern
+*
+* Returns: None
+*
+* Description: Draws a finder pattern along with the light separator around it
+ */
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+/*
+* Function: Code.drawAlignment
+*
+* Parameters: x int - The column of the center of the pattern
+*             y int - The row of the center of the pattern
+*
+* Returns: None
+*
+* Description: Draws a 5x5 alignment pattern
+ */
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+/*
+* Function: Code.drawFormatBits
+*
+* Parameters: mask int - The mask pattern that has been applied
+*
+* Returns: None
+*
+* Description: Draws both copies of the error correction level and mask, protected by a BCH code, along with the
+*              module that is always dark
+ */
+func (c *Code) drawFormatBits(mask int) {
+	data := levelFormatBits[c.Level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	// The copy around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(bits, i))
+	}
+	c.setFunction(8, 7, bit(bits, 6))
+	c.setFunction(8, 8, bit(bits, 7))
+	c.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(bits, i))
+	}
+
+	// The copy split between the other two finder patterns
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(bits, i))
+	}
+	c.setFunction(8, c.Size-8, true)
+}
+
+/*
+* Function: Code.drawVersion
+*
+* Parameters: None
+*
+* Returns: None
+*
+* Description: Draws both copies of the version number, protected by a BCH code. Only versions 7 and up have them
+ */
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+
+	rem := c.Version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := c.Version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		a := c.Size - 11 + i%3
+		b := i / 3
+		c.setFunction(a, b, bit(bits, i))
+		c.setFunction(b, a, bit(bits, i))
+	}
+}
+
+/*
+* Function: Code.drawCodewords
+*
+* Parameters: data []byte - The interleaved data and error correction codewords
+*
+* Returns: None
+*
+* Description: Places the codewords in the zigzag order of the standard, in two module wide columns starting at the
+*              bottom right and skipping the vertical timing pattern. Modules left over are the light remainder bits
+ */
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if upward {
+					y = c.Size - 1 - vert
+				}
+				if c.isFunction[y*c.Size+x] || i >= len(data)*8 {
+					continue
+				}
+				c.modules[y*c.Size+x] = bit(int(data[i>>3]), 7-i&7)
+				i++
+			}
+		}
+	}
+}
+
+/*
+* Function: Code.applyMask
+*
+* Parameters: mask int - The mask pattern, from 0 to 7
+*
+* Returns: None
+*
+* Description: Inverts the data modules selected by a mask pattern. Applying the same mask again undoes it
+ */
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			idx := y*c.Size + x
+			if invert && !c.isFunction[idx] {
+				c.modules[idx] = !c.modules[idx]
+			}
+		}
+	}
+}
+
+/*
+* Function: Code.penalty
+*
+* Parameters: None
+*
+* Returns: int - The penalty score of the code as it is currently masked
+*
+* Description: Scores how hard the code would be to read using the four rules of the standard: long runs of one
+*              color, 2x2 blocks of one color, patterns that look like finder patterns and an unbalanced number of
+*              dark modules
+ */
+func (c *Code) penalty() int {
+	result := 0
+
+	// Runs and finder-like patterns are scored the same way in rows and columns
+	line := make([]bool, c.Size)
+	for i := 0; i < c.Size; i++ {
+		for j := 0; j < c.Size; j++ {
+			line[j] = c.modules[i*c.Size+j]
+		}
+		result += linePenalty(line)
+		for j := 0; j < c.Size; j++ {
+			line[j] = c.modules[j*c.Size+i]
+		}
+		result += linePenalty(line)
+	}
+
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			color := c.modules[y*c.Size+x]
+			if color {
+				dark++
+			}
+			if x < c.Size-1 && y < c.Size-1 &&
+				color == c.modules[y*c.Size+x+1] &&
+				color == c.modules[(y+1)*c.Size+x] &&
+				color == c.modules[(y+1)*c.Size+x+1] {
+				result += 3
+			}
+		}
+	}
+
+	// 10 points for every 5% the dark modules are away from half of the code
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	result += k * 10
+
+	return result
+}
+
+// A finder pattern followed by four light modules, dark is true
+var finderLike = []bool{true, false, true, true, true, false, true, false, false, false, false}
+
+/*
+* Function: linePenalty
+*
+* Parameters: line []bool - One row or column of the code
+*
+* Returns: int - The penalty for runs of five or more modules of one color and finder-like patterns in the line
+*
+* Description: Scores the first and third penalty rules for a single line
+ */
+func linePenalty(line []bool) int {
+	result := 0
+
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			result += run - 2
+		}
+		run = 1
+	}
+
+	// The pattern is checked in both directions, with the light modules before or after it
+	for i := 0; i+len(finderLike) <= len(line); i++ {
+		forward, backward := true, true
+		for j, dark := range finderLike {
+			if line[i+j] != dark {
+				forward = false
+			}
+			if line[i+len(finderLike)-1-j] != dark {
+				backward = false
+			}
+		}
+		if forward {
+			result += 40
+		}
+		if backward {
+			result += 40
+		}
+	}
+
+	return result
+}
+
+/*
+* Function: Code.setFunction
+*
+* Parameters: x    int  - The column of the module
+*             y    int  - The row of the module
+*             dark bool - The color of the module
+*
+* Returns: None
+*
+* Description: Sets a module that belongs to a function pattern, so it is not used for data or masked
+ */
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y*c.Size+x] = dark
+	c.isFunction[y*c.Size+x] = true
+}
+
+/*
+* Function: alignmentPositions
+*
+* Parameters: version int - The version of the code
+*
+* Returns: []int - The rows and columns the centers of the alignment patterns lie on
+*
+* Description: Computes the alignment pattern positions, which are evenly spaced from the last row and column
+*              except for the first one at row and column 6
+ */
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	count := version/7 + 2
+	step := (version*8 + count*3 + 5) / (count*4 - 4) * 2
+	result := make([]int, count)
+	result[0] = 6
+	for i, pos := count-1, version*4+17-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+
+	return result
+}
+
+/*
+* Function: reedSolomonDivisor
+*
+* Parameters: degree int - The number of error correction codewords
+*
+* Returns: []byte - The coefficients of the generator polynomial, highest power first and without the leading 1
+*
+* Description: Computes the product of (x - 2^i) for i from 0 to degree-1 over GF(256)
+ */
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+
+	return result
+}
+
+/*
+* Function: reedSolomonRemainder
+*
+* Parameters: data    []byte - The data codewords of a block
+*             divisor []byte - The generator polynomial from reedSolomonDivisor
+*
+* Returns: []byte - The error correction codewords of the block
+*
+* Description: Computes the remainder of dividing the data polynomial by the generator polynomial
+ */
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+
+	return result
+}
+
+/*
+* Function: gfMultiply
+*
+* Parameters: x byte - A field element
+*             y byte - A field element
+*
+* Returns: byte - The product of x and y
+*
+* Description: Multiplies in GF(256) modulo the QR code polynomial x^8 + x^4 + x^3 + x^2 + 1
+ */
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+/*
+* Type: bitBuffer
+*
+* Description: A sequence of bits built up while encoding the data
+ */
+type bitBuffer []bool
+
+/*
+* Function: bitBuffer.append
+*
+* Parameters: value int - The value to append
+*             n     int - The number of low bits of value to append, most significant first
+*
+* Returns: None
+*
+* Description: Appends the low n bits of value to the buffer
+ */
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 == 1)
+	}
+}
+
+/*
+* Function: bitBuffer.bytes
+*
+* Parameters: None
+*
+* Returns: []byte - The bits packed into bytes, most significant bit first
+*
+* Description: Packs the buffer, whose length must be a multiple of 8, into bytes
+ */
+func (b bitBuffer) bytes() []byte {
+	result := make([]byte, len(b)/8)
+	for i, set := range b {
+		if set {
+			result[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+	return result
+}
+
+/*
+* Function: bit
+*
+* Parameters: value int - The value to read from
+*             i     int - The index of the bit, 0 is the least significant
+*
+* Returns: bool - true if the bit is set
+*
+* Description: Reads a single bit of a value
+ */
+func bit(value, i int) bool {
+	return value>>i&1 != 0
+}
+
+/*
+* Function: abs
+*
+* Parameters: x int - A number
+*
+* Returns: int - The absolute value of x
+*
+* Description: Returns the absolute value of an int
+ */
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,106 @@
+/*
+* File: pkg/qrcode/rendering.go
+*
+* Description: Functions for writing an encoded QR code as a PNG or SVG image, surrounded by a light quiet zone
+*
+ */
+
+package qrcode
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+/*
+* Function: Code.Image
+*
+* Parameters: moduleSize int - The width and height of each module in pixels
+*             margin     int - The width of the quiet zone around the code in modules
+*
+* Returns: image.Image - A black and white image of the code
+*
+* Description: Draws the code as a two color paletted image, which keeps the encoded PNG small
+ */
+func (c *Code) Image(moduleSize, margin int) image.Image {
+	moduleSize = max(moduleSize, 1)
+	margin = max(margin, 0)
+
+	width := (c.Size + 2*margin) * moduleSize
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.Dark(x, y) {
+				continue
+			}
+
+			// Index 1 of the palette is black
+			top := (y + margin) * moduleSize
+			left := (x + margin) * moduleSize
+			for row := top; row < top+moduleSize; row++ {
+				for col := left; col < left+moduleSize; col++ {
+					img.Pix[row*img.Stride+col] = 1
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+/*
+* Function: Code.WritePNG
+*
+* Parameters: w          io.Writer - Where to write the image
+*             moduleSize int       - The width and height of each module in pixels
+*             margin     int       - The width of the quiet zone around the code in modules
+*
+* Returns: error - Any error that occurred while encoding or writing the image
+*
+* Description: Writes the code as a PNG image
+ */
+func (c *Code) WritePNG(w io.Writer, moduleSize, margin int) error {
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	return encoder.Encode(w, c.Image(moduleSize, margin))
+}
+
+/*
+* Function: Code.WriteSVG
+*
+* Parameters: w      io.Writer - Where to write the image
+*             size   int       - The width and height of the image in pixels
+*             margin int       - The width of the quiet zone around the code in modules
+*
+* Returns: error - Any error that occurred while writing the image
+*
+* Description: Writes the code as an SVG image. The dark modules of each row are joined into runs and drawn as a
+*              single path, measured in modules so the image scales to any size without blurring
+ */
+func (c *Code) WriteSVG(w io.Writer, size, margin int) error {
+	margin = max(margin, 0)
+	width := c.Size + 2*margin
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, width, width)
+	fmt.Fprintf(out, `<rect width="%d" height="%d" fill="#ffffff"/><path fill="#000000" d="`, width, width)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.Dark(x, y) {
+				continue
+			}
+			run := 1
+			for c.Dark(x+run, y) {
+				run++
+			}
+			fmt.Fprintf(out, "M%d,%dh%dv1h-%dz", x+margin, y+margin, run, run)
+			x += run
+		}
+	}
+	fmt.Fprint(out, "\"/></svg>\n")
+
+	return out.Flush()
+}
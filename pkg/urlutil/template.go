@@ -0,0 +1,155 @@
+// File: pkg/urlutil/template.go
+// Includes the placeholders of template links, whose destination is filled in with values given by the visitor
+
+package urlutil
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches {1} to {99} for values taken from the path in order, and {name} for values taken from the query string.
+// Other uses of braces are left alone so that urls containing them still work
+var placeholderPattern = regexp.MustCompile(`\{([1-9][0-9]?|[A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Returned by ValidateTemplate when a placeholder is in the scheme or host of a url
+var ErrPlaceholderInHost = errors.New("placeholders can only be used in the path, query or fragment")
+
+/*
+* Struct: MissingValueError
+*
+* Description: Returned by ExpandTemplate when the visitor did not give a value a placeholder needs
+ */
+type MissingValueError struct {
+	Placeholder string // The placeholder without a value, such as "{1}" or "{project}"
+}
+
+func (e *MissingValueError) Error() string {
+	return "no value given for " + e.Placeholder
+}
+
+/*
+* Function: IsTemplate
+*
+* Parameters: rawURL string - A destination url
+*
+* Returns: bool - true if the url contains placeholders
+*
+* Description: Tells template links apart from plain ones
+ */
+func IsTemplate(rawURL string) bool {
+	return placeholderPattern.MatchString(rawURL)
+}
+
+/*
+* Function: Positionals
+*
+* Parameters: rawURL string - A destination url
+*
+* Returns: int - The highest positional placeholder in the url, 0 if it has none
+*
+* Description: Used to find out how many path segments a template link accepts
+ */
+func Positionals(rawURL string) int {
+	highest := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatch(rawURL, -1) {
+		if n, err := strconv.Atoi(match[1]); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest
+}
+
+/*
+* Function: ValidateTemplate
+*
+* Parameters: rawURL string - A destination url that may contain placeholders
+*
+* Returns: error - ErrPlaceholderInHost if a placeholder is in the scheme or host, nil for plain urls
+*
+* Description: Checks a template before it is stored. Placeholders in the host would let visitors pick the site
+*              they are sent to, so only the rest of the url can contain them
+ */
+func ValidateTemplate(rawURL string) error {
+	var authorityEnd int
+	if scheme := strings.Index(rawURL, "://"); scheme != -1 {
+		authorityEnd = len(rawURL)
+		if end := strings.IndexAny(rawURL[scheme+3:], "/?#"); end != -1 {
+			authorityEnd = scheme + 3 + end
+		}
+	} else {
+		// Urls such as mailto:{1} have no host, only the scheme needs protecting
+		authorityEnd = strings.Index(rawURL, ":") + 1
+	}
+
+	for _, match := range placeholderPattern.FindAllStringIndex(rawURL, -1) {
+		if match[0] < authorityEnd {
+			return ErrPlaceholderInHost
+		}
+	}
+
+	return nil
+}
+
+/*
+* Function: ExpandTemplate
+*
+* Parameters: template   string     - A destination url containing placeholders
+*             positional []string   - The values for {1}, {2} and so on, unescaped
+*             named      url.Values - The values for named placeholders
+*
+* Returns: string     - The url with every placeholder replaced
+*          url.Values - The named values no placeholder used
+*          error      - A *MissingValueError if a placeholder has no value, ErrDotSegment if a value in the path
+*                       is "." or ".."
+*
+* Description: Fills in a template. Each value is escaped for the part of the url it lands in, so a value can
+*              never add path segments, query parameters or a fragment of its own
+ */
+func ExpandTemplate(template string, positional []string, named url.Values) (string, url.Values, error) {
+	unused := make(url.Values)
+	for key, values := range named {
+		unused[key] = values
+	}
+
+	var expanded strings.Builder
+	last := 0
+	for _, match := range placeholderPattern.FindAllStringSubmatchIndex(template, -1) {
+		name := template[match[2]:match[3]]
+
+		var value string
+		if n, err := strconv.Atoi(name); err == nil {
+			if n > len(positional) {
+				return "", nil, &MissingValueError{Placeholder: "{" + name + "}"}
+			}
+			value = positional[n-1]
+		} else {
+			if !named.Has(name) {
+				return "", nil, &MissingValueError{Placeholder: "{" + name + "}"}
+			}
+			value = named.Get(name)
+			delete(unused, name)
+		}
+
+		// Values in the query are escaped as query values, everywhere else as a single path segment
+		before := template[:match[0]]
+		if strings.Contains(before, "?") && !strings.Contains(before, "#") {
+			value = url.QueryEscape(value)
+		} else {
+			if !strings.Contains(before, "#") && (value == "." || value == "..") {
+				return "", nil, ErrDotSegment
+			}
+			value = url.PathEscape(value)
+		}
+
+		expanded.WriteString(template[last:match[0]])
+		expanded.WriteString(value)
+		last = match[1]
+	}
+	expanded.WriteString(template[last:])
+
+	return expanded.String(), unused, nil
+}
@@ -0,0 +1,156 @@
+// File: pkg/urlutil/urlutil.go
+// Includes utilities for working with the destination URLs that links point to
+
+package urlutil
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+/*
+* Function: Normalize
+*
+* Parameters: rawURL string - The url to normalize
+*
+* Returns: string - The normalized form of the url
+*
+* Description: Converts a url into a canonical form so that urls which point to the same place compare equal.
+*              The scheme and host are lowercased, default ports and empty queries are removed, an empty path
+*              becomes "/" and query parameters are sorted. Urls that cannot be parsed are returned trimmed
+ */
+func Normalize(rawURL string) string {
+	trimmed := strings.TrimSpace(rawURL)
+
+	parsed, err := url.Parse(trimmed)
+	if err != nil {
+		return trimmed
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	parsed.Host = strings.ToLower(parsed.Host)
+
+	// Remove ports that are implied by the scheme
+	if (parsed.Scheme == "http" && parsed.Port() == "80") || (parsed.Scheme == "https" && parsed.Port() == "443") {
+		parsed.Host = parsed.Hostname()
+	}
+
+	if parsed.Host != "" && parsed.Path == "" {
+		parsed.Path = "/"
+	}
+
+	// Encode sorts the parameters by key which makes the order they were given in irrelevant
+	parsed.RawQuery = parsed.Query().Encode()
+	parsed.ForceQuery = false
+
+	return parsed.String()
+}
+
+/*
+* Function: MergeQuery
+*
+* Parameters: rawURL   string     - The url to add the parameters to
+*             params   url.Values - The query parameters to add
+*             override bool       - true to replace parameters the url already has, false to keep them
+*
+* Returns: string - The url with the parameters added
+*
+* Description: Adds query parameters to a url without re-encoding it, so the parameters already in the url keep
+*              their order and encoding. New parameters are appended sorted by key and the fragment stays last
+ */
+func MergeQuery(rawURL string, params url.Values, override bool) string {
+	if len(params) == 0 {
+		return rawURL
+	}
+
+	base, fragment, hasFragment := strings.Cut(rawURL, "#")
+	path, rawQuery, _ := strings.Cut(base, "?")
+
+	// Keep the existing pairs, apart from the ones being replaced
+	var pairs []string
+	existing := make(map[string]bool)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+
+		rawKey, _, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+
+		if override && params.Has(key) {
+			continue
+		}
+		existing[key] = true
+		pairs = append(pairs, pair)
+	}
+
+	added := make(url.Values)
+	for key, values := range params {
+		if !existing[key] {
+			added[key] = values
+		}
+	}
+	if encoded := added.Encode(); encoded != "" {
+		pairs = append(pairs, encoded)
+	}
+
+	result := path
+	if len(pairs) > 0 {
+		result += "?" + strings.Join(pairs, "&")
+	}
+	if hasFragment {
+		result += "#" + fragment
+	}
+
+	return result
+}
+
+// Returned by JoinPath when the path would climb out of the destination with "." or ".." segments
+var ErrDotSegment = errors.New("urlutil: path contains a dot segment")
+
+/*
+* Function: JoinPath
+*
+* Parameters: rawURL string - The url to add the path to
+*             suffix string - An escaped path such as "/api/v2", as found in a request url
+*
+* Returns: string - The url with the path appended to its own path, before its query and fragment
+*          error  - ErrDotSegment if the suffix contains a "." or ".." segment, escaped or not
+*
+* Description: Appends a path to a url with exactly one slash between them. The suffix is kept as it was escaped,
+*              so encoded slashes and other escapes reach the destination unchanged
+ */
+func JoinPath(rawURL string, suffix string) (string, error) {
+	suffix = strings.TrimLeft(suffix, "/")
+	if suffix == "" {
+		return rawURL, nil
+	}
+
+	for _, segment := range strings.Split(suffix, "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", err
+		}
+		if unescaped == "." || unescaped == ".." {
+			return "", ErrDotSegment
+		}
+	}
+
+	// The query and fragment of the url stay after the joined path
+	end := strings.IndexAny(rawURL, "?#")
+	if end == -1 {
+		end = len(rawURL)
+	}
+	base, rest := rawURL[:end], rawURL[end:]
+
+	// A url without a path such as https://example.com gets the suffix as its whole path
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	return base + suffix + rest, nil
+}
@@ -0,0 +1,111 @@
+/*
+* File: pkg/useragent/useragent.go
+*
+* Description: Classifies the User-Agent headers of requests, for example to recognise the crawlers that chat apps
+*              and social networks use to build link previews
+*
+ */
+
+package useragent
+
+import "strings"
+
+// Lowercased substrings of the user agents of link preview crawlers. Search engine crawlers are left out so they
+// keep getting the redirect
+var previewBots = []string{
+	"facebookexternalhit",
+	"facebookcatalog",
+	"facebot",
+	"twitterbot",
+	"slackbot",
+	"slack-imgproxy",
+	"linkedinbot",
+	"discordbot",
+	"telegrambot",
+	"whatsapp",
+	"skypeuripreview",
+	"microsoftpreview",
+	"pinterest",
+	"redditbot",
+	"embedly",
+	"iframely",
+	"vkshare",
+	"mastodon",
+	"bluesky",
+	"google-pagerenderer",
+	"snapchat",
+	"viber",
+	"line-poker",
+	"kakaotalk-scrap",
+	"mattermost-bot",
+	"zulip",
+}
+
+/*
+* Function: IsPreviewBot
+*
+* Parameters: userAgent string - The User-Agent header of a request
+*
+* Returns: bool - true if the request comes from a crawler that builds link previews
+*
+* Description: Matches the user agent against the crawlers of common chat apps and social networks
+ */
+func IsPreviewBot(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, bot := range previewBots {
+		if strings.Contains(userAgent, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+// The platforms returned by Platform
+const (
+	IOS      = "ios"
+	Android  = "android"
+	Windows  = "windows"
+	MacOS    = "macos"
+	Linux    = "linux"
+	ChromeOS = "chromeos"
+)
+
+// Platforms lists every platform Platform can return, in the order they are offered to users
+var Platforms = []string{IOS, Android, Windows, MacOS, Linux, ChromeOS}
+
+// Lowercased substrings that identify each platform. They are checked in order because some user agents name
+// more than one, Android browsers say Linux and iOS browsers say "like Mac OS X"
+var platformMarkers = []struct {
+	marker   string
+	platform string
+}{
+	{"iphone", IOS},
+	{"ipad", IOS},
+	{"ipod", IOS},
+	{"android", Android},
+	{"; cros ", ChromeOS},
+	{"windows", Windows},
+	{"macintosh", MacOS},
+	{"mac os x", MacOS},
+	{"linux", Linux},
+}
+
+/*
+* Function: Platform
+*
+* Parameters: userAgent string - The User-Agent header of a request
+*
+* Returns: string - One of the platform constants, empty if the platform is not recognised
+*
+* Description: Finds the operating system a request comes from. iPads set to request desktop sites report
+*              themselves as macOS and cannot be told apart
+ */
+func Platform(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	for _, entry := range platformMarkers {
+		if strings.Contains(userAgent, entry.marker) {
+			return entry.platform
+		}
+	}
+	return ""
+}